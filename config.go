@@ -71,11 +71,129 @@ type HTTPConfig struct {
 			File    string `json:"file" yaml:"file"`
 		} `json:"index" yaml:"index"`
 		Proxy struct {
-			Pass        string `json:"pass" yaml:"pass"`
-			AuthTable   string `json:"auth_table" yaml:"auth_table"`
-			StripPrefix string `json:"strip_prefix" yaml:"strip_prefix"`
-			SetHeaders  string `json:"set_headers" yaml:"set_headers"`
-			DumpFailure bool   `json:"dump_failure" yaml:"dump_failure"`
+			Pass                       string         `json:"pass" yaml:"pass"`
+			AuthTable                  string         `json:"auth_table" yaml:"auth_table"`
+			StripPrefix                string         `json:"strip_prefix" yaml:"strip_prefix"`
+			SetHeaders                 string         `json:"set_headers" yaml:"set_headers"`
+			DumpFailure                bool           `json:"dump_failure" yaml:"dump_failure"`
+			IgnoreTrailerError         bool           `json:"ignore_trailer_error" yaml:"ignore_trailer_error"`
+			RemoveRequestHeaders       []string       `json:"remove_request_headers" yaml:"remove_request_headers"`
+			RemoveResponseHeaders      []string       `json:"remove_response_headers" yaml:"remove_response_headers"`
+			DisableKeepAliveUpstreams  []string       `json:"disable_keepalive_upstreams" yaml:"disable_keepalive_upstreams"`
+			SetResponseHeaders         string         `json:"set_response_headers" yaml:"set_response_headers"`
+			LogGeoip                   bool           `json:"log_geoip" yaml:"log_geoip"`
+			PropagateConnectionClose   bool           `json:"propagate_connection_close" yaml:"propagate_connection_close"`
+			ForceConnectionClose       bool           `json:"force_connection_close" yaml:"force_connection_close"`
+			UpgradeInsecureRequests    bool           `json:"upgrade_insecure_requests" yaml:"upgrade_insecure_requests"`
+			WebsocketIdleTimeout       int            `json:"websocket_idle_timeout" yaml:"websocket_idle_timeout"`
+			ForceH2c                   bool           `json:"force_h2c" yaml:"force_h2c"`
+			EarlyHints                 bool           `json:"early_hints" yaml:"early_hints"`
+			Metrics                    bool           `json:"metrics" yaml:"metrics"`
+			AccessLog                  bool           `json:"access_log" yaml:"access_log"`
+			AccessLogFields            []string       `json:"access_log_fields" yaml:"access_log_fields"`
+			TracePropagation           bool           `json:"trace_propagation" yaml:"trace_propagation"`
+			DumpFailureRequest         bool           `json:"dump_failure_request" yaml:"dump_failure_request"`
+			DumpRedactHeaders          []string       `json:"dump_redact_headers" yaml:"dump_redact_headers"`
+			DumpMaxBytes               int            `json:"dump_max_bytes" yaml:"dump_max_bytes"`
+			DumpFailureRate            int            `json:"dump_failure_rate" yaml:"dump_failure_rate"`
+			ErrorStatusCodes           map[string]int `json:"error_status_codes" yaml:"error_status_codes"`
+			AccelRedirect              bool           `json:"accel_redirect" yaml:"accel_redirect"`
+			CircuitBreakerThreshold    int            `json:"circuit_breaker_threshold" yaml:"circuit_breaker_threshold"`
+			CircuitBreakerWindow       int            `json:"circuit_breaker_window" yaml:"circuit_breaker_window"`
+			CircuitBreakerCooldown     int            `json:"circuit_breaker_cooldown" yaml:"circuit_breaker_cooldown"`
+			MaxIdleConnsPerHost        int            `json:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+			MaxConnsPerHost            int            `json:"max_conns_per_host" yaml:"max_conns_per_host"`
+			IdleConnTimeout            int            `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+			UpstreamClientCert         string         `json:"upstream_client_cert" yaml:"upstream_client_cert"`
+			UpstreamClientKey          string         `json:"upstream_client_key" yaml:"upstream_client_key"`
+			UpstreamServerName         string         `json:"upstream_server_name" yaml:"upstream_server_name"`
+			UpstreamCaCert             string         `json:"upstream_ca_cert" yaml:"upstream_ca_cert"`
+			UpstreamInsecureSkipVerify bool           `json:"upstream_insecure_skip_verify" yaml:"upstream_insecure_skip_verify"`
+			ForwardJa4                 bool           `json:"forward_ja4" yaml:"forward_ja4"`
+			ForwardAlpn                bool           `json:"forward_alpn" yaml:"forward_alpn"`
+			ForwardJa4h                bool           `json:"forward_ja4h" yaml:"forward_ja4h"`
+			Deny                       struct {
+				Ja4            []string `json:"ja4" yaml:"ja4"`
+				UserAgentBot   bool     `json:"user_agent_bot" yaml:"user_agent_bot"`
+				UserAgentNames []string `json:"user_agent_names" yaml:"user_agent_names"`
+				Cidrs          []string `json:"cidrs" yaml:"cidrs"`
+				Status         int      `json:"status" yaml:"status"`
+				Tarpit         int      `json:"tarpit" yaml:"tarpit"`
+			} `json:"deny" yaml:"deny"`
+			CookieDomains          map[string]string `json:"cookie_domains" yaml:"cookie_domains"`
+			CookiePaths            map[string]string `json:"cookie_paths" yaml:"cookie_paths"`
+			CookieSecure           bool              `json:"cookie_secure" yaml:"cookie_secure"`
+			CookieSameSite         string            `json:"cookie_same_site" yaml:"cookie_same_site"`
+			MaxRequestHeaderBytes  int               `json:"max_request_header_bytes" yaml:"max_request_header_bytes"`
+			MaxResponseHeaderBytes int64             `json:"max_response_header_bytes" yaml:"max_response_header_bytes"`
+			MirrorPass             string            `json:"mirror_pass" yaml:"mirror_pass"`
+			MirrorSampleRate       float64           `json:"mirror_sample_rate" yaml:"mirror_sample_rate"`
+			Coalesce               bool              `json:"coalesce" yaml:"coalesce"`
+			AllowConnect           bool              `json:"allow_connect" yaml:"allow_connect"`
+			Maintenance            bool              `json:"maintenance" yaml:"maintenance"`
+			MaintenanceAllowIps    []string          `json:"maintenance_allow_ips" yaml:"maintenance_allow_ips"`
+			MaintenancePage        string            `json:"maintenance_page" yaml:"maintenance_page"`
+			MaintenanceRetryAfter  int               `json:"maintenance_retry_after" yaml:"maintenance_retry_after"`
+			MaxRetries             int               `json:"max_retries" yaml:"max_retries"`
+			RetryStatusCodes       []int             `json:"retry_status_codes" yaml:"retry_status_codes"`
+			RetryBackoff           int               `json:"retry_backoff" yaml:"retry_backoff"`
+			RetryBackoffMax        int               `json:"retry_backoff_max" yaml:"retry_backoff_max"`
+			RetryBackoffMultiplier float64           `json:"retry_backoff_multiplier" yaml:"retry_backoff_multiplier"`
+			AllowMethods           []string          `json:"allow_methods" yaml:"allow_methods"`
+			DisableWebsocket       bool              `json:"disable_websocket" yaml:"disable_websocket"`
+			SecurityHeaders        bool              `json:"security_headers" yaml:"security_headers"`
+			HstsMaxAge             int               `json:"hsts_max_age" yaml:"hsts_max_age"`
+			TapFile                string            `json:"tap_file" yaml:"tap_file"`
+			TapSampleRate          float64           `json:"tap_sample_rate" yaml:"tap_sample_rate"`
+			TapMaxBytes            int               `json:"tap_max_bytes" yaml:"tap_max_bytes"`
+			MaxResponseBodySize    int64             `json:"max_response_body_size" yaml:"max_response_body_size"`
+			RealIpHeader           *string           `json:"real_ip_header" yaml:"real_ip_header"`
+			ForwardedForHeader     *string           `json:"forwarded_for_header" yaml:"forwarded_for_header"`
+			ForwardHost            bool              `json:"forward_host" yaml:"forward_host"`
+			ForwardPort            bool              `json:"forward_port" yaml:"forward_port"`
+			Forwarded              bool              `json:"forwarded" yaml:"forwarded"`
+			Via                    string            `json:"via" yaml:"via"`
+			SrvRefresh             int               `json:"srv_refresh" yaml:"srv_refresh"`
+			StickyCookie           struct {
+				Name   string `json:"name" yaml:"name"`
+				Ttl    int    `json:"ttl" yaml:"ttl"`
+				Secret string `json:"secret" yaml:"secret"`
+			} `json:"sticky_cookie" yaml:"sticky_cookie"`
+			RequestIdHeader        string            `json:"request_id_header" yaml:"request_id_header"`
+			DialSourceAddr         string            `json:"dial_source_addr" yaml:"dial_source_addr"`
+			DialPolicy             string            `json:"dial_policy" yaml:"dial_policy"`
+			TcpKeepAlive           int               `json:"tcp_keep_alive" yaml:"tcp_keep_alive"`
+			TcpKeepAliveCount      int               `json:"tcp_keep_alive_count" yaml:"tcp_keep_alive_count"`
+			BufferRequestBody      bool              `json:"buffer_request_body" yaml:"buffer_request_body"`
+			BufferRequestMaxBytes  int64             `json:"buffer_request_max_bytes" yaml:"buffer_request_max_bytes"`
+			LogResponseHeaders     []string          `json:"log_response_headers" yaml:"log_response_headers"`
+			RewritePath            string            `json:"rewrite_path" yaml:"rewrite_path"`
+			AuthChallenges         []string          `json:"auth_challenges" yaml:"auth_challenges"`
+			Timeout                int               `json:"timeout" yaml:"timeout"`
+			TimeoutHeader          string            `json:"timeout_header" yaml:"timeout_header"`
+			MaxTimeout             int               `json:"max_timeout" yaml:"max_timeout"`
+			RequestBodyReadTimeout int               `json:"request_body_read_timeout" yaml:"request_body_read_timeout"`
+			MinRequestBodyRate     int64             `json:"min_request_body_rate" yaml:"min_request_body_rate"`
+			DisableForwardedProto  bool              `json:"disable_forwarded_proto" yaml:"disable_forwarded_proto"`
+			ResponseIdleTimeout    int               `json:"response_idle_timeout" yaml:"response_idle_timeout"`
+			HealthPath             string            `json:"health_path" yaml:"health_path"`
+			Upstreams              []string          `json:"upstreams" yaml:"upstreams"`
+			BufferResponse         bool              `json:"buffer_response" yaml:"buffer_response"`
+			BufferResponseMaxBytes int64             `json:"buffer_response_max_bytes" yaml:"buffer_response_max_bytes"`
+			ContentTypeRoutes      map[string]string `json:"content_type_routes" yaml:"content_type_routes"`
+			UpstreamHeader         string            `json:"upstream_header" yaml:"upstream_header"`
+			UpstreamHeaderAllowIPs []string          `json:"upstream_header_allow_ips" yaml:"upstream_header_allow_ips"`
+			DefaultPass            string            `json:"default_pass" yaml:"default_pass"`
+			MaxConcurrent          int               `json:"max_concurrent" yaml:"max_concurrent"`
+			MaxQueue               int               `json:"max_queue" yaml:"max_queue"`
+			QueueTimeout           int               `json:"queue_timeout" yaml:"queue_timeout"`
+			UnlimitedWebSocket     bool              `json:"unlimited_websocket" yaml:"unlimited_websocket"`
+			ResponseHeaderCase     []string          `json:"response_header_case" yaml:"response_header_case"`
+			AuthUserHeader         string            `json:"auth_user_header" yaml:"auth_user_header"`
+			AuthUserAttrHeaders    map[string]string `json:"auth_user_attr_headers" yaml:"auth_user_attr_headers"`
+			AuthUserSecret         string            `json:"auth_user_secret" yaml:"auth_user_secret"`
+			AuthSignatureHeader    string            `json:"auth_signature_header" yaml:"auth_signature_header"`
+			TrustedProxyIPs        []string          `json:"trusted_proxy_ips" yaml:"trusted_proxy_ips"`
 		} `json:"proxy" yaml:"proxy"`
 		Shell struct {
 			Enabled   bool              `json:"enabled" yaml:"enabled"`
@@ -175,33 +293,34 @@ type SshConfig struct {
 
 type Config struct {
 	Global struct {
-		LogDir           string `json:"log_dir" yaml:"log_dir"`
-		LogLevel         string `json:"log_level" yaml:"log_level"`
-		LogBackups       int    `json:"log_backups" yaml:"log_backups"`
-		LogMaxsize       int64  `json:"log_maxsize" yaml:"log_maxsize"`
-		LogLocaltime     bool   `json:"log_localtime" yaml:"log_localtime"`
-		LogChannelSize   uint   `json:"log_channel_size" yaml:"log_channel_size"`
-		ForbidLocalAddr  bool   `json:"forbid_local_addr" yaml:"forbid_local_addr"`
-		DialTimeout      int    `json:"dial_timeout" yaml:"dial_timeout"`
-		DialReadBuffer   int    `json:"dial_read_buffer" yaml:"dial_read_buffer"` // Danger, see https://issues.apache.org/jira/browse/KAFKA-16496
-		DialWriteBuffer  int    `json:"dial_write_buffer" yaml:"dial_write_buffer"`
-		DnsServer        string `json:"dns_server" yaml:"dns_server"`
-		DnsCacheDuration string `json:"dns_cache_duration" yaml:"dns_cache_duration"`
-		DnsCacheSize     int    `json:"dns_cache_size" yaml:"dns_cache_size"`
-		TcpReadBuffer    int    `json:"tcp_read_buffer" yaml:"tcp_read_buffer"`
-		TcpWriteBuffer   int    `json:"tcp_write_buffer" yaml:"tcp_write_buffer"`
-		TlsInsecure      bool   `json:"tls_insecure" yaml:"tls_insecure"`
-		AutocertDir      string `json:"autocert_dir" yaml:"autocert_dir"`
-		GeoipDir         string `json:"geoip_dir" yaml:"geoip_dir"`
-		GeoipCacheSize   int    `json:"geoip_cache_size" yaml:"geoip_cache_size"`
-		GeositeCacheSize int    `json:"geosite_cache_size" yaml:"geosite_cache_size"`
-		IdleConnTimeout  int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
-		MaxIdleConns     int    `json:"max_idle_conns" yaml:"max_idle_conns"`
-		DisableIpv6      bool   `json:"disable_ipv6" yaml:"disable_ipv6"`
-		DisableHttp3     bool   `json:"disable_http3" yaml:"disable_http3"`
-		DisableGeoip     bool   `json:"disable_geoip" yaml:"disable_geoip"`
-		DisableGeosite   bool   `json:"disable_geosite" yaml:"disable_geosite"`
-		SetProcessName   string `json:"set_process_name" yaml:"set_process_name"`
+		LogDir                string `json:"log_dir" yaml:"log_dir"`
+		LogLevel              string `json:"log_level" yaml:"log_level"`
+		LogBackups            int    `json:"log_backups" yaml:"log_backups"`
+		LogMaxsize            int64  `json:"log_maxsize" yaml:"log_maxsize"`
+		LogLocaltime          bool   `json:"log_localtime" yaml:"log_localtime"`
+		LogChannelSize        uint   `json:"log_channel_size" yaml:"log_channel_size"`
+		ForbidLocalAddr       bool   `json:"forbid_local_addr" yaml:"forbid_local_addr"`
+		DialTimeout           int    `json:"dial_timeout" yaml:"dial_timeout"`
+		DialReadBuffer        int    `json:"dial_read_buffer" yaml:"dial_read_buffer"` // Danger, see https://issues.apache.org/jira/browse/KAFKA-16496
+		DialWriteBuffer       int    `json:"dial_write_buffer" yaml:"dial_write_buffer"`
+		DnsServer             string `json:"dns_server" yaml:"dns_server"`
+		DnsCacheDuration      string `json:"dns_cache_duration" yaml:"dns_cache_duration"`
+		DnsCacheSize          int    `json:"dns_cache_size" yaml:"dns_cache_size"`
+		TcpReadBuffer         int    `json:"tcp_read_buffer" yaml:"tcp_read_buffer"`
+		TcpWriteBuffer        int    `json:"tcp_write_buffer" yaml:"tcp_write_buffer"`
+		TlsInsecure           bool   `json:"tls_insecure" yaml:"tls_insecure"`
+		AutocertDir           string `json:"autocert_dir" yaml:"autocert_dir"`
+		GeoipDir              string `json:"geoip_dir" yaml:"geoip_dir"`
+		GeoipCacheSize        int    `json:"geoip_cache_size" yaml:"geoip_cache_size"`
+		GeositeCacheSize      int    `json:"geosite_cache_size" yaml:"geosite_cache_size"`
+		IdleConnTimeout       int    `json:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+		MaxIdleConns          int    `json:"max_idle_conns" yaml:"max_idle_conns"`
+		DisableIpv6           bool   `json:"disable_ipv6" yaml:"disable_ipv6"`
+		DisableHttp3          bool   `json:"disable_http3" yaml:"disable_http3"`
+		DisableGeoip          bool   `json:"disable_geoip" yaml:"disable_geoip"`
+		DisableGeosite        bool   `json:"disable_geosite" yaml:"disable_geosite"`
+		SetProcessName        string `json:"set_process_name" yaml:"set_process_name"`
+		HttpReadHeaderTimeout int    `json:"http_read_header_timeout" yaml:"http_read_header_timeout"`
 	} `json:"global" yaml:"global"`
 	Cron []struct {
 		Spec    string `json:"spec" yaml:"spec"`
@@ -310,6 +429,8 @@ func NewConfig(filename string) (*Config, error) {
 			config.Http[i].Web[j].Index.Body = read(config.Http[i].Web[j].Index.Body)
 			config.Http[i].Web[j].Proxy.Pass = read(config.Http[i].Web[j].Proxy.Pass)
 			config.Http[i].Web[j].Proxy.SetHeaders = read(config.Http[i].Web[j].Proxy.SetHeaders)
+			config.Http[i].Web[j].Proxy.MaintenancePage = read(config.Http[i].Web[j].Proxy.MaintenancePage)
+			config.Http[i].Web[j].Proxy.SetResponseHeaders = read(config.Http[i].Web[j].Proxy.SetResponseHeaders)
 		}
 	}
 	for i := range config.Https {
@@ -321,6 +442,8 @@ func NewConfig(filename string) (*Config, error) {
 			config.Https[i].Web[j].Index.Body = read(config.Https[i].Web[j].Index.Body)
 			config.Https[i].Web[j].Proxy.Pass = read(config.Https[i].Web[j].Proxy.Pass)
 			config.Https[i].Web[j].Proxy.SetHeaders = read(config.Https[i].Web[j].Proxy.SetHeaders)
+			config.Https[i].Web[j].Proxy.MaintenancePage = read(config.Https[i].Web[j].Proxy.MaintenancePage)
+			config.Https[i].Web[j].Proxy.SetResponseHeaders = read(config.Https[i].Web[j].Proxy.SetResponseHeaders)
 		}
 	}
 	for i := range config.Socks {
@@ -22,6 +22,9 @@ var (
 	DialerHTTPHeaderContextKey      any = &DialerContextKey{"dailer-http-header"}
 	DialerDisableIPv6ContextKey     any = &DialerContextKey{"dailer-disable-ipv6"}
 	DialerPreferIPv6ContextKey      any = &DialerContextKey{"dailer-prefer-ipv6"}
+	DialerHappyEyeballsContextKey   any = &DialerContextKey{"dailer-happy-eyeballs"}
+	DialerLocalAddrContextKey       any = &DialerContextKey{"dailer-local-addr"}
+	DialerTCPKeepAliveContextKey    any = &DialerContextKey{"dailer-tcp-keepalive"}
 	DialerMemoryDialersContextKey   any = &DialerContextKey{"dailer-memory-dialers"}
 	DialerMemoryListenersContextKey any = &DialerContextKey{"dailer-memory-listeners"}
 )
@@ -82,6 +82,14 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 		return nil, net.InvalidAddrError("empty dns record: " + host)
 	}
 
+	// a source address only reaches the upstream addresses of its family
+	if laddr, _ := ctx.Value(DialerLocalAddrContextKey).(netip.Addr); laddr.IsValid() {
+		ips = slices.DeleteFunc(slices.Clone(ips), func(ip netip.Addr) bool { return ip.Unmap().Is4() != laddr.Unmap().Is4() })
+		if len(ips) == 0 {
+			return nil, net.InvalidAddrError("no dns record matches local address " + laddr.String() + ": " + host)
+		}
+	}
+
 	var perfers = ips
 	var fallbacks []netip.Addr
 	switch {
@@ -110,7 +118,10 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 
 	concurrency := max(d.Concurrency, 1)
 	dial := d.dialParallel
-	if concurrency <= 1 || len(perfers) == 1 {
+	switch {
+	case ctx.Value(DialerHappyEyeballsContextKey) != nil && fallbacks == nil && slices.ContainsFunc(perfers, func(ip netip.Addr) bool { return ip.Is4() != perfers[0].Is4() }):
+		dial = d.dialHappyEyeballs
+	case concurrency <= 1 || len(perfers) == 1:
 		dial = d.dialSerial
 	}
 
@@ -126,7 +137,24 @@ func (d *LocalDialer) dialContext(ctx context.Context, network, address string,
 	return conn, err
 }
 
+// setKeepAlive applies the keepalive config from context, e.g. of a web proxy route, or TCPKeepAlive.
+func (d *LocalDialer) setKeepAlive(ctx context.Context, conn *net.TCPConn) {
+	if config, ok := ctx.Value(DialerTCPKeepAliveContextKey).(net.KeepAliveConfig); ok {
+		conn.SetKeepAliveConfig(config)
+		return
+	}
+	if d.TCPKeepAlive > 0 {
+		conn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     d.TCPKeepAlive,
+			Interval: d.TCPKeepAlive,
+		})
+	}
+}
+
 func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string, ips []netip.Addr, port uint16, tlsConfig *tls.Config) (conn net.Conn, err error) {
+	laddr, _ := ctx.Value(DialerLocalAddrContextKey).(netip.Addr)
+
 	for i, ip := range ips {
 		if IsMemoryAddress(ip) {
 			return nil, net.InvalidAddrError("reserved address is unreachable: " + ip.String())
@@ -141,7 +169,7 @@ func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string,
 			dailer.Control = (&DailerController{Interface: d.Interface}).Control
 		}
 
-		conn, err := dailer.DialTCP(ctx, network, netip.AddrPort{}, netip.AddrPortFrom(ip, port))
+		conn, err := dailer.DialTCP(ctx, network, netip.AddrPortFrom(laddr, 0), netip.AddrPortFrom(ip, port))
 		if err != nil {
 			if i < len(ips)-1 {
 				continue
@@ -150,13 +178,7 @@ func (d *LocalDialer) dialSerial(ctx context.Context, network, hostname string,
 			}
 		}
 
-		if d.TCPKeepAlive > 0 {
-			conn.SetKeepAliveConfig(net.KeepAliveConfig{
-				Enable:   true,
-				Idle:     d.TCPKeepAlive,
-				Interval: d.TCPKeepAlive,
-			})
-		}
+		d.setKeepAlive(ctx, conn)
 
 		if d.ReadBuffSize > 0 {
 			conn.SetReadBuffer(d.ReadBuffSize)
@@ -197,6 +219,8 @@ func (d *LocalDialer) dialParallel(ctx context.Context, network, hostname string
 		ips = ips[:level]
 	}
 
+	laddr, _ := ctx.Value(DialerLocalAddrContextKey).(netip.Addr)
+
 	lane := make(chan dialResult, level)
 	for i := 0; i < level; i++ {
 		go func(ip netip.Addr, port uint16, tlsConfig *tls.Config) {
@@ -212,19 +236,13 @@ func (d *LocalDialer) dialParallel(ctx context.Context, network, hostname string
 			if d.Interface != "" {
 				dailer.Control = (&DailerController{Interface: d.Interface}).Control
 			}
-			conn, err := dailer.DialTCP(ctx, network, netip.AddrPort{}, netip.AddrPortFrom(ip, port))
+			conn, err := dailer.DialTCP(ctx, network, netip.AddrPortFrom(laddr, 0), netip.AddrPortFrom(ip, port))
 			if err != nil {
 				lane <- dialResult{nil, err}
 				return
 			}
 
-			if d.TCPKeepAlive > 0 {
-				conn.SetKeepAliveConfig(net.KeepAliveConfig{
-					Enable:   true,
-					Idle:     d.TCPKeepAlive,
-					Interval: d.TCPKeepAlive,
-				})
-			}
+			d.setKeepAlive(ctx, conn)
 
 			if d.ReadBuffSize > 0 {
 				conn.SetReadBuffer(d.ReadBuffSize)
@@ -270,3 +288,79 @@ func (d *LocalDialer) dialParallel(ctx context.Context, network, hostname string
 
 	return nil, r.Err
 }
+
+// dialHappyEyeballs dials the addresses alternating between families as RFC 8305, a next attempt starts
+// every 250ms or as soon as the previous one failed, and the first established connection wins.
+func (d *LocalDialer) dialHappyEyeballs(ctx context.Context, network, hostname string, ips []netip.Addr, port uint16, tlsConfig *tls.Config) (net.Conn, error) {
+	type dialResult struct {
+		Conn net.Conn
+		Err  error
+	}
+
+	var primaries, secondaries []netip.Addr
+	for _, ip := range ips {
+		if ip.Is4() == ips[0].Is4() {
+			primaries = append(primaries, ip)
+		} else {
+			secondaries = append(secondaries, ip)
+		}
+	}
+	ips = make([]netip.Addr, 0, len(ips))
+	for i := range max(len(primaries), len(secondaries)) {
+		if i < len(primaries) {
+			ips = append(ips, primaries[i])
+		}
+		if i < len(secondaries) {
+			ips = append(ips, secondaries[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lane := make(chan dialResult, len(ips))
+	drain := func(count int) {
+		for ; count > 0; count-- {
+			if r := <-lane; r.Conn != nil {
+				r.Conn.Close()
+			}
+		}
+	}
+
+	var err error
+	next, pending := 0, 0
+	for {
+		if next < len(ips) {
+			go func(ip netip.Addr) {
+				conn, err := d.dialSerial(ctx, network, hostname, []netip.Addr{ip}, port, tlsConfig)
+				lane <- dialResult{conn, err}
+			}(ips[next])
+			next++
+			pending++
+		}
+
+		var delay <-chan time.Time
+		if next < len(ips) {
+			delay = time.After(250 * time.Millisecond)
+		}
+
+		select {
+		case r := <-lane:
+			pending--
+			if r.Err == nil {
+				go drain(pending)
+				return r.Conn, nil
+			}
+			if err == nil {
+				err = r.Err
+			}
+			if pending == 0 && next == len(ips) {
+				return nil, err
+			}
+		case <-delay:
+		case <-ctx.Done():
+			go drain(pending)
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"net/http"
@@ -65,11 +66,15 @@ func (f *Functions) Load() error {
 	f.funcs["wildcardMatch"] = f.wildcardMatch
 
 	// http related
+	f.funcs["chash"] = f.chash
+	f.funcs["canary"] = f.canary
 	f.funcs["country"] = f.country
 	f.funcs["dnsResolve"] = f.dnsResolve
 	f.funcs["nslookup"] = f.nslookup
 	f.funcs["domain"] = f.domain
 	f.funcs["fetch"] = f.fetch
+	f.funcs["geoASN"] = f.geoASN
+	f.funcs["geoCountry"] = f.geoCountry
 	f.funcs["geoip"] = f.geoip
 	f.funcs["geosite"] = f.geosite
 	f.funcs["greased"] = f.greased
@@ -168,6 +173,34 @@ func (f *Functions) country(ip string) string {
 	return f.geoip(ip).Country
 }
 
+// geoaddr accepts a string, netip.Addr or netip.AddrPort, e.g. .RealIP or .RemoteAddr of templates.
+func (f *Functions) geoaddr(addr any) (info GeoIPInfo) {
+	var ip netip.Addr
+	switch v := addr.(type) {
+	case netip.Addr:
+		ip = v
+	case netip.AddrPort:
+		ip = v.Addr()
+	case string:
+		if s, _, err := net.SplitHostPort(v); err == nil {
+			v = s
+		}
+		ip, _ = netip.ParseAddr(v)
+	}
+	if !ip.IsValid() || f.GeoResolver == nil {
+		return
+	}
+	return f.GeoResolver.GetGeoIPInfo(context.Background(), ip.Unmap())
+}
+
+func (f *Functions) geoCountry(addr any) string {
+	return f.geoaddr(addr).Country
+}
+
+func (f *Functions) geoASN(addr any) string {
+	return f.geoaddr(addr).ASN
+}
+
 func (f *Functions) dnsResolve(host string) string {
 	if s, _, err := net.SplitHostPort(host); err == nil {
 		host = s
@@ -305,6 +338,52 @@ func (f *Functions) fetch(ua string, timeout, ttl int, uri string) (response Fet
 	return
 }
 
+// chash picks one of upstreams for key by rendezvous hashing, adding or removing
+// an upstream only remaps the keys which belong to it. upstreams may be given as
+// separate arguments or as a single comma separated string.
+func (f *Functions) chash(key string, upstreams ...string) string {
+	if len(upstreams) == 1 && strings.Contains(upstreams[0], ",") {
+		upstreams = strings.Split(upstreams[0], ",")
+	}
+
+	var result string
+	var score uint64
+	for _, upstream := range upstreams {
+		if upstream = strings.TrimSpace(upstream); upstream == "" {
+			continue
+		}
+		h := fnv.New64a()
+		io.WriteString(h, upstream)
+		h.Write([]byte{0})
+		io.WriteString(h, key)
+		x := mix64(h.Sum64())
+		if result == "" || x > score {
+			result, score = upstream, x
+		}
+	}
+
+	return result
+}
+
+// canary returns canaryUpstream for percent of keys and stableUpstream for the rest,
+// e.g. {{ canary (.Request.Header.Get "x-user-id") 5 "http://v2:8080" "http://v1:8080" }}.
+// the cohort of a key is stable across requests and liner restarts.
+func (f *Functions) canary(key string, percent float64, canaryUpstream, stableUpstream string) string {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	if float64(mix64(h.Sum64())%10000) < percent*100 {
+		return canaryUpstream
+	}
+	return stableUpstream
+}
+
+// mix64 is the splitmix64 finalizer, for a better avalanche of fnv.
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
 func (f *Functions) ipRange(cidr string) (result IPRange) {
 	result, _ = GetIPRange(strings.TrimSpace(cidr))
 	return
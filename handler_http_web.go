@@ -2,12 +2,14 @@ package main
 
 import (
 	"expvar"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/phuslu/log"
 	"github.com/smallnest/ringbuffer"
@@ -15,6 +17,7 @@ import (
 
 type HTTPWebHandler struct {
 	Config          HTTPConfig
+	DnsResolver     *DnsResolver
 	DnsResolverPool *DnsResolverPool
 	MemoryDialers   *MemoryDialers
 	MemoryLogWriter *ringbuffer.RingBuffer
@@ -65,14 +68,133 @@ func (h *HTTPWebHandler) Load() error {
 			}
 		case web.Proxy.Pass != "":
 			router.handler = &HTTPWebProxyHandler{
-				MemoryDialers: h.MemoryDialers,
-				Transport:     h.Transport,
-				Functions:     h.Functions,
-				Pass:          web.Proxy.Pass,
-				AuthTable:     web.Proxy.AuthTable,
-				StripPrefix:   web.Proxy.StripPrefix,
-				SetHeaders:    web.Proxy.SetHeaders,
-				DumpFailure:   web.Proxy.DumpFailure,
+				MemoryDialers:              h.MemoryDialers,
+				DnsResolver:                h.DnsResolver,
+				Transport:                  h.Transport,
+				Functions:                  h.Functions,
+				Pass:                       web.Proxy.Pass,
+				AuthTable:                  web.Proxy.AuthTable,
+				StripPrefix:                web.Proxy.StripPrefix,
+				SetHeaders:                 web.Proxy.SetHeaders,
+				DumpFailure:                web.Proxy.DumpFailure,
+				IgnoreTrailerError:         web.Proxy.IgnoreTrailerError,
+				RemoveRequestHeaders:       web.Proxy.RemoveRequestHeaders,
+				RemoveResponseHeaders:      web.Proxy.RemoveResponseHeaders,
+				DisableKeepAliveUpstreams:  web.Proxy.DisableKeepAliveUpstreams,
+				SetResponseHeaders:         web.Proxy.SetResponseHeaders,
+				LogGeoIP:                   web.Proxy.LogGeoip,
+				PropagateConnectionClose:   web.Proxy.PropagateConnectionClose,
+				ForceConnectionClose:       web.Proxy.ForceConnectionClose,
+				UpgradeInsecureRequests:    web.Proxy.UpgradeInsecureRequests,
+				WebSocketIdleTimeout:       time.Duration(web.Proxy.WebsocketIdleTimeout) * time.Second,
+				ForceH2C:                   web.Proxy.ForceH2c,
+				EarlyHints:                 web.Proxy.EarlyHints,
+				Metrics:                    web.Proxy.Metrics,
+				AccessLog:                  web.Proxy.AccessLog,
+				AccessLogFields:            web.Proxy.AccessLogFields,
+				TracePropagation:           web.Proxy.TracePropagation,
+				DumpFailureRequest:         web.Proxy.DumpFailureRequest,
+				DumpRedactHeaders:          web.Proxy.DumpRedactHeaders,
+				DumpMaxBytes:               web.Proxy.DumpMaxBytes,
+				DumpFailureRate:            web.Proxy.DumpFailureRate,
+				ErrorStatusCodes:           web.Proxy.ErrorStatusCodes,
+				AccelRedirect:              web.Proxy.AccelRedirect,
+				CircuitBreakerThreshold:    web.Proxy.CircuitBreakerThreshold,
+				CircuitBreakerWindow:       time.Duration(web.Proxy.CircuitBreakerWindow) * time.Second,
+				CircuitBreakerCooldown:     time.Duration(web.Proxy.CircuitBreakerCooldown) * time.Second,
+				MaxIdleConnsPerHost:        web.Proxy.MaxIdleConnsPerHost,
+				MaxConnsPerHost:            web.Proxy.MaxConnsPerHost,
+				IdleConnTimeout:            time.Duration(web.Proxy.IdleConnTimeout) * time.Second,
+				UpstreamClientCert:         web.Proxy.UpstreamClientCert,
+				UpstreamClientKey:          web.Proxy.UpstreamClientKey,
+				UpstreamServerName:         web.Proxy.UpstreamServerName,
+				UpstreamCACert:             web.Proxy.UpstreamCaCert,
+				UpstreamInsecureSkipVerify: web.Proxy.UpstreamInsecureSkipVerify,
+				ForwardJA4:                 web.Proxy.ForwardJa4,
+				ForwardALPN:                web.Proxy.ForwardAlpn,
+				ForwardJA4H:                web.Proxy.ForwardJa4h,
+				Deny: HTTPWebProxyDeny{
+					JA4:            web.Proxy.Deny.Ja4,
+					UserAgentBot:   web.Proxy.Deny.UserAgentBot,
+					UserAgentNames: web.Proxy.Deny.UserAgentNames,
+					CIDRs:          web.Proxy.Deny.Cidrs,
+					Status:         web.Proxy.Deny.Status,
+					Tarpit:         time.Duration(web.Proxy.Deny.Tarpit) * time.Second,
+				},
+				CookieDomains:          web.Proxy.CookieDomains,
+				CookiePaths:            web.Proxy.CookiePaths,
+				CookieSecure:           web.Proxy.CookieSecure,
+				CookieSameSite:         web.Proxy.CookieSameSite,
+				MaxRequestHeaderBytes:  web.Proxy.MaxRequestHeaderBytes,
+				MaxResponseHeaderBytes: web.Proxy.MaxResponseHeaderBytes,
+				MirrorPass:             web.Proxy.MirrorPass,
+				MirrorSampleRate:       web.Proxy.MirrorSampleRate,
+				Coalesce:               web.Proxy.Coalesce,
+				AllowConnect:           web.Proxy.AllowConnect,
+				Maintenance:            web.Proxy.Maintenance,
+				MaintenanceAllowIPs:    web.Proxy.MaintenanceAllowIps,
+				MaintenancePage:        web.Proxy.MaintenancePage,
+				MaintenanceRetryAfter:  web.Proxy.MaintenanceRetryAfter,
+				MaxRetries:             web.Proxy.MaxRetries,
+				RetryStatusCodes:       web.Proxy.RetryStatusCodes,
+				RetryBackoff:           time.Duration(web.Proxy.RetryBackoff) * time.Second,
+				RetryBackoffMax:        time.Duration(web.Proxy.RetryBackoffMax) * time.Second,
+				RetryBackoffMultiplier: web.Proxy.RetryBackoffMultiplier,
+				AllowMethods:           web.Proxy.AllowMethods,
+				DisableWebSocket:       web.Proxy.DisableWebsocket,
+				SecurityHeaders:        web.Proxy.SecurityHeaders,
+				HSTSMaxAge:             web.Proxy.HstsMaxAge,
+				TapFile:                web.Proxy.TapFile,
+				TapSampleRate:          web.Proxy.TapSampleRate,
+				TapMaxBytes:            web.Proxy.TapMaxBytes,
+				MaxResponseBodySize:    web.Proxy.MaxResponseBodySize,
+				RealIPHeader:           web.Proxy.RealIpHeader,
+				ForwardedForHeader:     web.Proxy.ForwardedForHeader,
+				ForwardHost:            web.Proxy.ForwardHost,
+				ForwardPort:            web.Proxy.ForwardPort,
+				Forwarded:              web.Proxy.Forwarded,
+				Via:                    web.Proxy.Via,
+				SRVRefresh:             time.Duration(web.Proxy.SrvRefresh) * time.Second,
+				StickyCookie: HTTPWebProxyStickyCookie{
+					Name:   web.Proxy.StickyCookie.Name,
+					TTL:    time.Duration(web.Proxy.StickyCookie.Ttl) * time.Second,
+					Secret: web.Proxy.StickyCookie.Secret,
+				},
+				RequestIDHeader:        web.Proxy.RequestIdHeader,
+				DialSourceAddr:         web.Proxy.DialSourceAddr,
+				DialPolicy:             web.Proxy.DialPolicy,
+				TCPKeepAlive:           time.Duration(web.Proxy.TcpKeepAlive) * time.Second,
+				TCPKeepAliveCount:      web.Proxy.TcpKeepAliveCount,
+				BufferRequestBody:      web.Proxy.BufferRequestBody,
+				BufferRequestMaxBytes:  web.Proxy.BufferRequestMaxBytes,
+				LogResponseHeaders:     web.Proxy.LogResponseHeaders,
+				RewritePath:            web.Proxy.RewritePath,
+				AuthChallenges:         web.Proxy.AuthChallenges,
+				Timeout:                time.Duration(web.Proxy.Timeout) * time.Second,
+				TimeoutHeader:          web.Proxy.TimeoutHeader,
+				MaxTimeout:             time.Duration(web.Proxy.MaxTimeout) * time.Second,
+				RequestBodyReadTimeout: time.Duration(web.Proxy.RequestBodyReadTimeout) * time.Second,
+				MinRequestBodyRate:     web.Proxy.MinRequestBodyRate,
+				DisableForwardedProto:  web.Proxy.DisableForwardedProto,
+				ResponseIdleTimeout:    time.Duration(web.Proxy.ResponseIdleTimeout) * time.Second,
+				HealthPath:             web.Proxy.HealthPath,
+				Upstreams:              web.Proxy.Upstreams,
+				BufferResponse:         web.Proxy.BufferResponse,
+				BufferResponseMaxBytes: web.Proxy.BufferResponseMaxBytes,
+				ContentTypeRoutes:      web.Proxy.ContentTypeRoutes,
+				UpstreamHeader:         web.Proxy.UpstreamHeader,
+				UpstreamHeaderAllowIPs: web.Proxy.UpstreamHeaderAllowIPs,
+				DefaultPass:            web.Proxy.DefaultPass,
+				MaxConcurrent:          web.Proxy.MaxConcurrent,
+				MaxQueue:               web.Proxy.MaxQueue,
+				QueueTimeout:           time.Duration(web.Proxy.QueueTimeout) * time.Second,
+				UnlimitedWebSocket:     web.Proxy.UnlimitedWebSocket,
+				ResponseHeaderCase:     web.Proxy.ResponseHeaderCase,
+				AuthUserHeader:         web.Proxy.AuthUserHeader,
+				AuthUserAttrHeaders:    web.Proxy.AuthUserAttrHeaders,
+				AuthUserSecret:         web.Proxy.AuthUserSecret,
+				AuthSignatureHeader:    web.Proxy.AuthSignatureHeader,
+				TrustedProxyIPs:        web.Proxy.TrustedProxyIPs,
 			}
 		case web.Shell.Enabled:
 			router.handler = &HTTPWebShellHandler{
@@ -112,6 +234,14 @@ func (h *HTTPWebHandler) Load() error {
 		}
 		log.Info().Str("web_location", x.location).Msgf("%T.Load() ok", x.handler)
 
+		handler := x.handler
+		if m, ok := handler.(*HTTPWebMiddlewareForwardAuth); ok {
+			handler = m.Handler
+		}
+		if proxy, ok := handler.(*HTTPWebProxyHandler); ok && proxy.MetricsRegistry != nil {
+			webProxyMetrics.Set(strings.Join(h.Config.Listen, ",")+x.location, proxy.MetricsRegistry)
+		}
+
 		if x.location == "/" {
 			root = x.handler
 			continue
@@ -1,52 +1,249 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"net/http/httptrace"
 	"net/netip"
+	"net/textproto"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/template"
+	"time"
 
+	sprig "github.com/go-task/slim-sprig/v3"
 	"github.com/mileusna/useragent"
 	"github.com/phuslu/log"
+	"github.com/puzpuzpuz/xsync/v4"
 	"github.com/quic-go/quic-go/http3"
 	"github.com/valyala/bytebufferpool"
 )
 
 type HTTPWebProxyHandler struct {
 	MemoryDialers *MemoryDialers
+	DnsResolver   *DnsResolver
 	Transport     *http.Transport
-	Functions     template.FuncMap
-	Pass          string
-	AuthBasic     string
-	AuthTable     string
-	StripPrefix   string
-	SetHeaders    string
-	DumpFailure   bool
+	// Functions extend the template functions of pass, set_headers and the like, except env which only
+	// reads LINER_ variables and fails the template for any other name.
+	Functions   template.FuncMap
+	Pass        string
+	AuthBasic   string
+	AuthTable   string
+	StripPrefix string
+	SetHeaders  string
+	DumpFailure bool
+
+	IgnoreTrailerError    bool
+	RemoveRequestHeaders  []string
+	RemoveResponseHeaders []string
+
+	DisableKeepAliveUpstreams  []string
+	SetResponseHeaders         string
+	LogGeoIP                   bool
+	PropagateConnectionClose   bool
+	ForceConnectionClose       bool
+	UpgradeInsecureRequests    bool
+	WebSocketIdleTimeout       time.Duration
+	ForceH2C                   bool
+	EarlyHints                 bool
+	Metrics                    bool
+	MetricsRegistry            *HTTPWebProxyMetrics
+	AccessLog                  bool
+	AccessLogFields            []string
+	TracePropagation           bool
+	Tracer                     HTTPWebProxyTracer
+	DumpFailureRequest         bool
+	DumpRedactHeaders          []string
+	DumpMaxBytes               int
+	DumpFailureRate            int
+	ErrorStatusCodes           map[string]int
+	AccelRedirect              bool
+	CircuitBreakerThreshold    int
+	CircuitBreakerWindow       time.Duration
+	CircuitBreakerCooldown     time.Duration
+	MaxIdleConnsPerHost        int
+	MaxConnsPerHost            int
+	IdleConnTimeout            time.Duration
+	UpstreamClientCert         string
+	UpstreamClientKey          string
+	UpstreamServerName         string
+	UpstreamCACert             string
+	UpstreamInsecureSkipVerify bool
+	ForwardJA4                 bool
+	ForwardALPN                bool
+	ForwardJA4H                bool
+	Deny                       HTTPWebProxyDeny
+	CookieDomains              map[string]string
+	CookiePaths                map[string]string
+	CookieSecure               bool
+	CookieSameSite             string
+	MaxRequestHeaderBytes      int
+	MaxResponseHeaderBytes     int64
+	MirrorPass                 string
+	MirrorSampleRate           float64
+	Coalesce                   bool
+	AllowConnect               bool
+	Maintenance                bool
+	MaintenanceAllowIPs        []string
+	MaintenancePage            string
+	MaintenanceRetryAfter      int
+	MaxRetries                 int
+	RetryStatusCodes           []int
+	RetryBackoff               time.Duration
+	RetryBackoffMax            time.Duration
+	RetryBackoffMultiplier     float64
+	AllowMethods               []string
+	DisableWebSocket           bool
+	SecurityHeaders            bool
+	HSTSMaxAge                 int
+	TapFile                    string
+	TapSampleRate              float64
+	TapMaxBytes                int
+	MaxResponseBodySize        int64
+	RealIPHeader               *string
+	ForwardedForHeader         *string
+	ForwardHost                bool
+	ForwardPort                bool
+	Forwarded                  bool
+	Via                        string
+	SRVRefresh                 time.Duration
+	StickyCookie               HTTPWebProxyStickyCookie
+	RequestIDHeader            string
+	DialSourceAddr             string
+	DialPolicy                 string
+	TCPKeepAlive               time.Duration
+	TCPKeepAliveCount          int
+	BufferRequestBody          bool
+	BufferRequestMaxBytes      int64
+	LogResponseHeaders         []string
+	RewritePath                string
+	AuthChallenges             []string
+	Timeout                    time.Duration
+	TimeoutHeader              string
+	MaxTimeout                 time.Duration
+	RequestBodyReadTimeout     time.Duration
+	MinRequestBodyRate         int64
+	DisableForwardedProto      bool
+	ResponseIdleTimeout        time.Duration
+	HealthPath                 string
+	Upstreams                  []string
+	BufferResponse             bool
+	BufferResponseMaxBytes     int64
+	ContentTypeRoutes          map[string]string
+	UpstreamHeader             string
+	UpstreamHeaderAllowIPs     []string
+	DefaultPass                string
+	MaxConcurrent              int
+	MaxQueue                   int // 0 queues up to MaxConcurrent requests, -1 rejects at once without a queue
+	QueueTimeout               time.Duration
+	UnlimitedWebSocket         bool
+	ResponseHeaderCase         []string
+	AuthUserHeader             string
+	AuthUserAttrHeaders        map[string]string
+	AuthUserSecret             string
+	AuthSignatureHeader        string
+	TrustedProxyIPs            []string
+
+	// Resolver computes the upstream instead of the pass template for embedders,
+	// the result is parsed the same way as a rendered pass.
+	Resolver func(*http.Request, *HTTPRequestInfo) (string, error)
+
+	// GetClientCertificate selects the client certificate per upstream host:port for embedders, e.g. a SPIFFE SVID,
+	// it falls back to UpstreamClientCert when it returns a nil certificate.
+	GetClientCertificate func(upstream string, info *tls.CertificateRequestInfo) (*tls.Certificate, error)
 
 	userchecker AuthUserChecker
 	proxypass   struct {
-		Code     int
+		Status   *proxyPassStatus
 		URL      *url.URL
 		Template *template.Template
 	}
-	h3transport *http3.Transport
-	headers     *template.Template
+	h3transport  *http3.Transport
+	h2ctransport *http.Transport
+	nokeepalive  *http.Transport
+	headers      *template.Template
+	respheaders  *template.Template
+	mirrorpass   *template.Template
+	tapper       *log.Logger
+	breakers     *xsync.Map[string, *webProxyBreaker]
+	calls        *xsync.Map[string, *webProxyCall]
+	srvs         *xsync.Map[string, *webProxySRV]
+	upstreams    []*net.SRV
+	defaultpass  *url.URL
+	ctroutes     map[string]*url.URL
+	denycidrs    []netip.Prefix
+	maintenance  atomic.Bool
+	maintcidrs   []netip.Prefix
+	upcidrs      []netip.Prefix
+	trustcidrs   []netip.Prefix
+	rewritepath  *regexp.Regexp
+	rewriteto    string
+	realip       string
+	forwardedfor string
+
+	draining atomic.Bool
+	inflight atomic.Int64
+	sem      chan struct{}
+	queued   atomic.Int64
+
+	dumpminute     atomic.Int64
+	dumpcount      atomic.Int64
+	dumpsuppressed atomic.Int64
 }
 
 func (h *HTTPWebProxyHandler) Load() error {
 	var err error
 
+	// a curated set of sprig helpers, ja4match, cookie, encoders and env for proxy templates, user provided functions take precedence except env
+	funcs, sprigs := make(template.FuncMap), sprig.GenericFuncMap()
+	for _, name := range []string{"lower", "upper", "trimPrefix", "trimSuffix", "hasPrefix", "split", "replace", "regexMatch", "default"} {
+		funcs[name] = sprigs[name]
+	}
+	funcs["ja4match"] = ja4match
+	funcs["cookie"] = cookie
+	// decoding errors render empty instead of failing the template, urlquery is a text/template builtin
+	funcs["b64enc"] = func(s string) string { return base64.StdEncoding.EncodeToString(s2b(s)) }
+	funcs["b64dec"] = func(s string) string {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+	funcs["hexenc"] = func(s string) string { return hex.EncodeToString(s2b(s)) }
+	maps.Copy(funcs, h.Functions)
+	// env is evaluated per request and limited to LINER_ variables, e.g. {{ env "LINER_UPSTREAM_TOKEN" }}
+	// keeps secrets out of the config file without exposing the rest of the process environment,
+	// any other name fails the template so a typo is not silently forwarded as an empty secret
+	funcs["env"] = func(name string) (string, error) {
+		if !strings.HasPrefix(name, "LINER_") {
+			return "", fmt.Errorf("env %q is not allowed, only LINER_ variables are", name)
+		}
+		return os.Getenv(name), nil
+	}
+	h.Functions = funcs
+
 	if table := h.AuthTable; table != "" {
 		loader := NewAuthUserLoaderFromTable(table)
 		records, err := loader.LoadAuthUsers(context.Background())
@@ -57,8 +254,19 @@ func (h *HTTPWebProxyHandler) Load() error {
 		h.userchecker = &AuthUserLoadChecker{loader}
 	}
 
-	if code, err := strconv.Atoi(strings.TrimSpace(h.Pass)); err == nil && code > 0 {
-		h.proxypass.Code = code
+	for _, scheme := range h.AuthChallenges {
+		if name, _, _ := strings.Cut(scheme, " "); strings.EqualFold(name, "Digest") {
+			return errors.New("web proxy auth_challenges does not support Digest, credentials are verified as Basic only")
+		}
+	}
+
+	// an unauthenticated CONNECT would be an open proxy to any host:port, including internal ones
+	if h.AllowConnect && h.userchecker == nil {
+		return errors.New("web proxy allow_connect requires an auth_table")
+	}
+
+	if status, ok := parseProxyPassStatus(h.Pass); ok {
+		h.proxypass.Status = &status
 	} else if !strings.Contains(h.Pass, "{{") {
 		h.proxypass.URL, err = url.Parse(strings.TrimSpace(h.Pass))
 		if err != nil {
@@ -76,6 +284,310 @@ func (h *HTTPWebProxyHandler) Load() error {
 		EnableDatagrams:    true,
 	}
 
+	// per route pool sizing and limits, non-zero fields take precedence over the shared transport
+	if h.MaxIdleConnsPerHost > 0 || h.MaxConnsPerHost > 0 || h.IdleConnTimeout > 0 || h.MaxResponseHeaderBytes > 0 {
+		h.Transport = h.Transport.Clone()
+		if h.MaxResponseHeaderBytes > 0 {
+			h.Transport.MaxResponseHeaderBytes = h.MaxResponseHeaderBytes
+		}
+		if h.MaxIdleConnsPerHost > 0 {
+			h.Transport.MaxIdleConnsPerHost = h.MaxIdleConnsPerHost
+		}
+		if h.MaxConnsPerHost > 0 {
+			h.Transport.MaxConnsPerHost = h.MaxConnsPerHost
+		}
+		if h.IdleConnTimeout > 0 {
+			h.Transport.IdleConnTimeout = h.IdleConnTimeout
+		}
+	}
+
+	// route local upstream tls settings, applied to a clone of the shared transport
+	if h.UpstreamClientCert != "" || h.UpstreamServerName != "" || h.UpstreamCACert != "" || h.UpstreamInsecureSkipVerify || h.GetClientCertificate != nil {
+		h.Transport = h.Transport.Clone()
+		if h.Transport.TLSClientConfig == nil {
+			h.Transport.TLSClientConfig = new(tls.Config)
+		}
+		h.h3transport.TLSClientConfig = new(tls.Config)
+		configs := []*tls.Config{h.Transport.TLSClientConfig, h.h3transport.TLSClientConfig}
+
+		if h.UpstreamClientCert != "" {
+			certfile := &FileLoader[tls.Certificate]{
+				Filename: h.UpstreamClientCert,
+				Logger:   log.DefaultLogger.Slog(),
+				Unmarshal: func(data []byte, v any) (err error) {
+					cert, ok := v.(*tls.Certificate)
+					if !ok {
+						return errors.New("*tls.Certificate required")
+					}
+					key := data
+					if h.UpstreamClientKey != "" {
+						if key, err = os.ReadFile(h.UpstreamClientKey); err != nil {
+							return err
+						}
+					}
+					*cert, err = tls.X509KeyPair(data, key)
+					return
+				},
+			}
+			if certfile.Load() == nil {
+				return fmt.Errorf("web proxy load upstream client cert %#v failed", h.UpstreamClientCert)
+			}
+			// the certfile is polled and reloaded on change, for rotation
+			for _, config := range configs {
+				config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return certfile.Load(), nil
+				}
+			}
+		}
+
+		if h.GetClientCertificate != nil {
+			for _, config := range configs {
+				static := config.GetClientCertificate
+				config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					upstream, _ := info.Context().Value(webProxyUpstreamKey).(string)
+					cert, err := h.GetClientCertificate(upstream, info)
+					if cert == nil && err == nil {
+						if static != nil {
+							return static(info)
+						}
+						// an empty certificate means no client certificate is sent
+						cert = new(tls.Certificate)
+					}
+					return cert, err
+				}
+			}
+		}
+
+		var roots *x509.CertPool
+		if h.UpstreamCACert != "" {
+			data, err := os.ReadFile(h.UpstreamCACert)
+			if err != nil {
+				return err
+			}
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(data) {
+				return fmt.Errorf("web proxy load upstream ca cert %#v failed", h.UpstreamCACert)
+			}
+		}
+
+		for _, config := range configs {
+			if h.UpstreamServerName != "" {
+				config.ServerName = h.UpstreamServerName
+			}
+			if roots != nil {
+				config.RootCAs = roots
+			}
+			if h.UpstreamInsecureSkipVerify {
+				config.InsecureSkipVerify = true
+			}
+		}
+	}
+
+	// rewrite_path is a regexp and a replacement, e.g. "^/api/v1(/.*) $1"
+	if h.RewritePath != "" {
+		parts := strings.Fields(h.RewritePath)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rewrite_path %q, want a regexp and a replacement", h.RewritePath)
+		}
+		if h.rewritepath, err = regexp.Compile(parts[0]); err != nil {
+			return fmt.Errorf("invalid rewrite_path %q: %w", h.RewritePath, err)
+		}
+		h.rewriteto = parts[1]
+	}
+
+	// default_pass is a proxypass status or a http(s) url
+	if _, ok := parseProxyPassStatus(h.DefaultPass); h.DefaultPass != "" && !ok {
+		h.defaultpass, err = url.Parse(strings.TrimSpace(h.DefaultPass))
+		if err != nil {
+			return fmt.Errorf("invalid default_pass %q: %w", h.DefaultPass, err)
+		}
+		if h.defaultpass.Scheme != "http" && h.defaultpass.Scheme != "https" {
+			return fmt.Errorf("invalid default_pass %q: want a http or https url", h.DefaultPass)
+		}
+	}
+
+	for mediatype, pass := range h.ContentTypeRoutes {
+		u, err := url.Parse(strings.TrimSpace(pass))
+		if err != nil {
+			return fmt.Errorf("invalid content_type_routes %s: %w", mediatype, err)
+		}
+		if h.ctroutes == nil {
+			h.ctroutes = make(map[string]*url.URL)
+		}
+		h.ctroutes[strings.ToLower(mediatype)] = u
+	}
+
+	// upstreams are "host:port [weight=N] [priority=N]", lower priorities take the traffic while healthy
+	for _, line := range h.Upstreams {
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(parts[0])
+		if err != nil {
+			return fmt.Errorf("invalid upstream %q: %w", line, err)
+		}
+		addr := &net.SRV{Target: host, Weight: 1}
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid upstream %q: %w", line, err)
+		}
+		addr.Port = uint16(n)
+		for _, part := range parts[1:] {
+			key, value, _ := strings.Cut(part, "=")
+			n, err := strconv.ParseUint(value, 10, 16)
+			switch {
+			case err != nil:
+				return fmt.Errorf("invalid upstream %q: %w", line, err)
+			case key == "weight":
+				addr.Weight = uint16(n)
+			case key == "priority":
+				addr.Priority = uint16(n)
+			default:
+				return fmt.Errorf("invalid upstream %q: unknown option %s", line, key)
+			}
+		}
+		h.upstreams = append(h.upstreams, addr)
+	}
+	slices.SortStableFunc(h.upstreams, func(a, b *net.SRV) int { return cmp.Compare(a.Priority, b.Priority) })
+	if len(h.upstreams) != 0 && h.proxypass.URL == nil {
+		return fmt.Errorf("web proxy upstreams require a static pass url, not %q", h.Pass)
+	}
+	// the failover between priorities is driven by the circuit breakers of the upstreams
+	if len(h.upstreams) != 0 && h.upstreams[0].Priority != h.upstreams[len(h.upstreams)-1].Priority && h.CircuitBreakerThreshold <= 0 {
+		return fmt.Errorf("web proxy upstreams of several priorities require a circuit_breaker_threshold")
+	}
+
+	if h.RetryBackoff < 0 || h.RetryBackoffMax < 0 || h.RetryBackoffMultiplier < 0 {
+		return fmt.Errorf("web proxy retry_backoff, retry_backoff_max and retry_backoff_multiplier must not be negative")
+	}
+	if h.RetryBackoffMultiplier != 0 && h.RetryBackoffMultiplier < 1 {
+		return fmt.Errorf("web proxy retry_backoff_multiplier %v must be at least 1", h.RetryBackoffMultiplier)
+	}
+	if h.RetryBackoffMax != 0 && h.RetryBackoffMax < h.RetryBackoff {
+		return fmt.Errorf("web proxy retry_backoff_max %v must not be less than retry_backoff %v", h.RetryBackoffMax, h.RetryBackoff)
+	}
+
+	switch h.DialPolicy {
+	case "", "happy_eyeballs", "prefer_ipv4", "prefer_ipv6":
+	default:
+		return fmt.Errorf("invalid dial_policy %s, want happy_eyeballs, prefer_ipv4 or prefer_ipv6", h.DialPolicy)
+	}
+
+	// per route dial options are passed to the dialer by context, on a transport of its own
+	// so the pooled connections of other routes are not reused.
+	if h.DialSourceAddr != "" || h.TCPKeepAlive > 0 {
+		dialer := new(net.Dialer)
+		var laddr netip.Addr
+		if h.DialSourceAddr != "" {
+			laddr, err = netip.ParseAddr(h.DialSourceAddr)
+			if err != nil {
+				return fmt.Errorf("invalid dial_source_addr %s: %w", h.DialSourceAddr, err)
+			}
+			ln, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(laddr, 0)))
+			if err != nil {
+				return fmt.Errorf("dial_source_addr %s is not bindable: %w", h.DialSourceAddr, err)
+			}
+			ln.Close()
+			dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(laddr, 0))
+		}
+		if h.TCPKeepAlive > 0 {
+			// dead upstream connections behind a nat are reaped after idle + interval * count
+			dialer.KeepAliveConfig = net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     h.TCPKeepAlive,
+				Interval: h.TCPKeepAlive,
+				Count:    cmp.Or(h.TCPKeepAliveCount, 3),
+			}
+		}
+		h.Transport = h.Transport.Clone()
+		dial := h.Transport.DialContext
+		if dial == nil {
+			dial = dialer.DialContext
+		}
+		h.Transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if laddr.IsValid() {
+				ctx = context.WithValue(ctx, DialerLocalAddrContextKey, laddr)
+			}
+			if h.TCPKeepAlive > 0 {
+				ctx = context.WithValue(ctx, DialerTCPKeepAliveContextKey, dialer.KeepAliveConfig)
+			}
+			return dial(ctx, network, address)
+		}
+	}
+
+	// cleartext http2 with prior knowledge, for h2c:// upstreams or http:// upstreams when ForceH2C is set
+	h.h2ctransport = h.Transport.Clone()
+	h.h2ctransport.Protocols = new(http.Protocols)
+	h.h2ctransport.Protocols.SetUnencryptedHTTP2(true)
+
+	// nil keeps the default header name, an empty string disables the header
+	h.realip, h.forwardedfor = "x-real-ip", "x-forwarded-for"
+	if h.RealIPHeader != nil {
+		h.realip = *h.RealIPHeader
+	}
+	if h.ForwardedForHeader != nil {
+		h.forwardedfor = *h.ForwardedForHeader
+	}
+
+	if h.denycidrs, err = parsePrefixes(h.Deny.CIDRs); err != nil {
+		return fmt.Errorf("web proxy invalid deny cidrs: %w", err)
+	}
+
+	if h.maintcidrs, err = parsePrefixes(h.MaintenanceAllowIPs); err != nil {
+		return fmt.Errorf("web proxy invalid maintenance allow ips: %w", err)
+	}
+	h.maintenance.Store(h.Maintenance)
+
+	if h.upcidrs, err = parsePrefixes(h.UpstreamHeaderAllowIPs); err != nil {
+		return fmt.Errorf("web proxy invalid upstream header allow ips: %w", err)
+	}
+
+	if h.trustcidrs, err = parsePrefixes(h.TrustedProxyIPs); err != nil {
+		return fmt.Errorf("web proxy invalid trusted proxy ips: %w", err)
+	}
+
+	if h.MaxConcurrent > 0 {
+		h.sem = make(chan struct{}, h.MaxConcurrent)
+	}
+
+	if h.Coalesce {
+		// the coalesce key only covers the client request, a response must not be shared across
+		// the identities or fingerprints that are injected into the upstream request per client.
+		switch {
+		case strings.Contains(h.SetHeaders, "{{"):
+			return errors.New("web proxy coalesce does not support templated set_headers")
+		case h.AuthUserHeader != "" || len(h.AuthUserAttrHeaders) != 0:
+			return errors.New("web proxy coalesce does not support auth_user_header, auth_user_attr_headers or auth_user_secret")
+		case h.ForwardJA4 || h.ForwardALPN || h.ForwardJA4H:
+			return errors.New("web proxy coalesce does not support forward_ja4, forward_alpn or forward_ja4h")
+		}
+		h.calls = xsync.NewMap[string, *webProxyCall]()
+	}
+
+	if h.CircuitBreakerThreshold > 0 {
+		h.breakers = xsync.NewMap[string, *webProxyBreaker]()
+	}
+
+	if h.Metrics && h.MetricsRegistry == nil {
+		h.MetricsRegistry = new(HTTPWebProxyMetrics)
+	}
+
+	h.srvs = xsync.NewMap[string, *webProxySRV]()
+
+	if h.AuthUserSecret != "" && h.AuthUserHeader == "" {
+		return errors.New("auth_user_secret requires an auth_user_header")
+	}
+
+	if h.StickyCookie.Name != "" && h.StickyCookie.Secret == "" {
+		return fmt.Errorf("sticky_cookie %s requires a secret", h.StickyCookie.Name)
+	}
+
+	if len(h.DisableKeepAliveUpstreams) != 0 || h.ForceConnectionClose {
+		h.nokeepalive = h.Transport.Clone()
+		h.nokeepalive.DisableKeepAlives = true
+	}
+
 	if strings.Contains(h.SetHeaders, "{{") {
 		h.headers, err = template.New(h.SetHeaders).Funcs(h.Functions).Parse(h.SetHeaders)
 		if err != nil {
@@ -83,16 +595,179 @@ func (h *HTTPWebProxyHandler) Load() error {
 		}
 	}
 
+	if strings.Contains(h.SetResponseHeaders, "{{") {
+		h.respheaders, err = template.New(h.SetResponseHeaders).Funcs(h.Functions).Parse(h.SetResponseHeaders)
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.TapFile != "" {
+		h.tapper = &log.Logger{
+			Writer: &log.AsyncWriter{
+				ChannelSize: 1024,
+				Writer: &log.FileWriter{
+					Filename:     h.TapFile,
+					MaxBackups:   2,
+					MaxSize:      100 * 1024 * 1024,
+					EnsureFolder: true,
+				},
+			},
+		}
+	}
+
+	if h.MirrorPass != "" {
+		h.mirrorpass, err = template.New(h.MirrorPass).Funcs(h.Functions).Parse(h.MirrorPass)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetMaintenance turns the maintenance mode on or off at runtime.
+func (h *HTTPWebProxyHandler) SetMaintenance(on bool) {
+	h.maintenance.Store(on)
+}
+
+// Drain makes the handler refuse new requests with 503, and waits for in-flight requests
+// including websocket and stream copies to complete, or ctx is done.
+func (h *HTTPWebProxyHandler) Drain(ctx context.Context) error {
+	h.draining.Store(true)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for h.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 	return nil
 }
 
 func (h *HTTPWebProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ri := req.Context().Value(HTTPRequestInfoContextKey).(*HTTPRequestInfo)
 
-	// if req.Method == http.MethodConnect {
-	// 	RejectRequest(rw, req)
-	// 	return
-	// }
+	// liveness probes of liner itself, answered before auth and deny rules
+	if h.HealthPath != "" && req.URL.Path == h.HealthPath {
+		h.health(rw, req)
+		return
+	}
+
+	h.inflight.Add(1)
+	defer h.inflight.Add(-1)
+
+	if h.draining.Load() {
+		rw.Header().Set("connection", "close")
+		http.Error(rw, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	st := &webProxyState{Host: req.Host}
+	if h.ForwardJA4H {
+		// fingerprint the client headers before any of them is rewritten
+		st.JA4H = string(AppendJA4HFingerprint(nil, req))
+	}
+
+	if name := h.RequestIDHeader; name != "" {
+		// an inbound request id is only honored from a trusted downstream proxy
+		id := req.Header.Get(name)
+		if id != "" && h.trustedDownstream(ri) {
+			ri.LogContext = log.NewContext(ri.LogContext).Str("request_id", id).Value()
+		} else {
+			id = ri.TraceID.String()
+		}
+		req.Header.Set(name, id)
+		rw.Header().Set(name, id)
+	}
+
+	if h.AccelRedirect {
+		// keep a pristine copy, the request is rewritten for upstream by the proxy step
+		st.Origin = req.Clone(req.Context())
+	}
+
+	if h.AccessLog {
+		cw := &HTTPCountingResponseWriter{ResponseWriter: rw}
+		rw = cw
+		defer h.accessLog(req.Method, req.URL.Path, time.Now(), cw, &st.Upstream, &st.Reused, ri)
+	}
+
+	// see https://www.w3.org/TR/upgrade-insecure-requests/#preference
+	if h.UpgradeInsecureRequests && ri.TLSVersion == 0 && req.Header.Get("upgrade-insecure-requests") == "1" {
+		host := req.Host
+		if s, _, err := net.SplitHostPort(host); err == nil {
+			host = s
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		rw.Header().Add("vary", "Upgrade-Insecure-Requests")
+		http.Redirect(rw, req, "https://"+host+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	if h.MaxRequestHeaderBytes > 0 {
+		size := len(req.Method) + len(req.RequestURI) + len(req.Host)
+		for key, values := range req.Header {
+			for _, value := range values {
+				size += len(key) + len(value) + 4
+			}
+		}
+		if size > h.MaxRequestHeaderBytes {
+			log.Warn().Context(ri.LogContext).Int("request_header_bytes", size).Int("max_request_header_bytes", h.MaxRequestHeaderBytes).Msg("web proxy request header too large")
+			http.Error(rw, "431 Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+	}
+
+	if h.maintenance.Load() && !slices.ContainsFunc(h.maintcidrs, func(prefix netip.Prefix) bool { return prefix.Contains(ri.RealIP) }) {
+		rw.Header().Set("retry-after", strconv.Itoa(cmp.Or(h.MaintenanceRetryAfter, 300)))
+		if h.MaintenancePage == "" {
+			http.Error(rw, "503 Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("content-type", "text/html; charset=utf-8")
+		rw.Header().Set("cache-control", "no-store")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(rw, h.MaintenancePage)
+		return
+	}
+
+	if h.denied(ri) {
+		log.Info().Context(ri.LogContext).NetIPAddr("remote_ip", ri.RealIP).Str("ja4", ri.JA4).Str("user_agent", ri.UserAgent.String).Msg("web proxy deny request")
+		if h.Deny.Tarpit > 0 {
+			select {
+			case <-time.After(h.Deny.Tarpit):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		switch code := cmp.Or(h.Deny.Status, http.StatusForbidden); code {
+		case 444:
+			// nginx style, close the connection without a response
+			panic(http.ErrAbortHandler)
+		default:
+			http.Error(rw, strconv.Itoa(code)+" "+http.StatusText(code), code)
+		}
+		return
+	}
+
+	// websockets and CONNECT are controlled by DisableWebSocket and AllowConnect instead of AllowMethods
+	websocket := req.Method == http.MethodConnect && req.Header.Get(":protocol") != "" ||
+		req.ProtoMajor == 1 && strings.EqualFold(req.Header.Get("upgrade"), "websocket")
+	switch {
+	case websocket && h.DisableWebSocket:
+		http.Error(rw, "403 websocket is not allowed", http.StatusForbidden)
+		return
+	case !websocket && req.Method != http.MethodConnect && len(h.AllowMethods) != 0 && !slices.ContainsFunc(h.AllowMethods, func(method string) bool { return strings.EqualFold(method, req.Method) }):
+		rw.Header().Set("allow", strings.ToUpper(strings.Join(h.AllowMethods, ", ")))
+		http.Error(rw, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	if h.userchecker != nil {
 		err := h.userchecker.CheckAuthUser(req.Context(), &ri.AuthUserInfo)
@@ -103,325 +778,1036 @@ func (h *HTTPWebProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reques
 		}
 		if err != nil {
 			log.Error().Context(ri.LogContext).Err(err).Any("user_attrs", ri.AuthUserInfo.Attrs).Msg("web proxy auth error")
-			rw.Header().Set("www-authenticate", `Basic realm="`+h.AuthBasic+`"`)
+			h.challenge(rw)
 			http.Error(rw, "401 unauthorised: "+err.Error(), http.StatusUnauthorized)
 
 			return
 		}
 	}
 
-	var proxypass *url.URL
-	switch {
-	case h.proxypass.Code > 0:
-		http.Error(rw, fmt.Sprintf("%d %s", h.proxypass.Code, http.StatusText(h.proxypass.Code)), h.proxypass.Code)
-		return
-	case h.proxypass.URL != nil:
-		proxypass = h.proxypass.URL
-	default:
-		ri.PolicyBuffer.Reset()
-		if obfuscated {
-			h.proxypass.Template.Execute(&ri.PolicyBuffer, map[string]any{
-				"Request":         req,
-				"RealIP":          ri.RealIP,
-				"ClientHelloInfo": ri.ClientHelloInfo,
-				"JA4":             ri.JA4,
-				"UserAgent":       &ri.UserAgent,
-				"ServerAddr":      ri.ServerAddr,
-			})
-		} else {
-			h.proxypass.Template.Execute(&ri.PolicyBuffer, struct {
-				Request         *http.Request
-				RealIP          netip.Addr
-				ClientHelloInfo *tls.ClientHelloInfo
-				JA4             string
-				UserAgent       *useragent.UserAgent
-				ServerAddr      netip.AddrPort
-			}{
-				Request:         req,
-				RealIP:          ri.RealIP,
-				ClientHelloInfo: ri.ClientHelloInfo,
-				JA4:             ri.JA4,
-				UserAgent:       &ri.UserAgent,
-				ServerAddr:      ri.ServerAddr,
-			})
-		}
-		var err error
-		proxypass, err = url.Parse(strings.TrimSpace(b2s(ri.PolicyBuffer.B)))
-		if err != nil {
-			http.Error(rw, fmt.Sprintf("bad proxypass %+v", proxypass), http.StatusServiceUnavailable)
+	// websockets hold their slot for the lifetime of the connection unless unlimited_websocket is set,
+	// x-accel-redirect hops are redispatched into the proxy step and share the slot.
+	if h.sem != nil && !(websocket && h.UnlimitedWebSocket) {
+		if !h.acquire(req.Context()) {
+			log.Warn().Context(ri.LogContext).Int("max_concurrent", h.MaxConcurrent).Int64("queued", h.queued.Load()).Msg("web proxy concurrency limit exceeded")
+			rw.Header().Set("retry-after", "1")
+			http.Error(rw, "503 Service Unavailable", http.StatusServiceUnavailable)
 			return
 		}
+		defer func() { <-h.sem }()
+	}
+
+	if req.Method == http.MethodConnect && req.Header.Get(":protocol") == "" && h.AllowConnect {
+		h.connect(rw, req, ri)
+		return
+	}
+
+	h.proxy(rw, req, ri, st)
+}
+
+// webProxyState is the per request state shared by ServeHTTP and the proxy step.
+type webProxyState struct {
+	Host      string        // host of the client request
+	Origin    *http.Request // pristine client request for x-accel-redirect
+	Redirects int           // x-accel-redirect hops taken
+	Upstream  string        // upstream host:port for the access log
+	Reused    bool          // whether the upstream connection was reused, for the access log
+	JA4H      string        // ja4h fingerprint of the client request
+}
+
+// webProxyMaxAccelRedirects caps the x-accel-redirect hops of a client request.
+const webProxyMaxAccelRedirects = 8
+
+// proxy resolves the upstream of req and relays it, an x-accel-redirect of upstream is redispatched here
+// so the checks and accounting of ServeHTTP run once per client request.
+func (h *HTTPWebProxyHandler) proxy(rw http.ResponseWriter, req *http.Request, ri *HTTPRequestInfo, st *webProxyState) {
+	proxypass, fallback, ok := h.route(rw, req, ri)
+	if !ok {
+		return
+	}
+
+	// the target selection may take the probe of a half-open circuit breaker, which is given back
+	// if the request returns before the round trip records a result.
+	proxypass, breaker, ok := h.selectTarget(rw, req, ri, proxypass)
+	if !ok {
+		return
 	}
+	recorded := false
+	defer func() {
+		if breaker != nil && !recorded {
+			breaker.Release()
+		}
+	}()
+
+	st.Upstream = proxypass.Host
 
 	if proxypass.Scheme == "file" {
 		http.Error(rw, "use index_root instead of file://", http.StatusServiceUnavailable)
 		return
 	}
 
+	req = req.WithContext(h.withDialPolicy(req.Context()))
+	if h.GetClientCertificate != nil {
+		req = req.WithContext(context.WithValue(req.Context(), webProxyUpstreamKey, proxypass.Host))
+	}
 	if h.MemoryDialers != nil {
 		req = req.WithContext(MemoryDialersWith(req.Context(), h.MemoryDialers))
 	}
 
+	for _, key := range h.RemoveRequestHeaders {
+		req.Header.Del(key)
+	}
+
+	// identity headers are only ever set by liner, client supplied values are dropped, and the username
+	// parsed from the authorization header is trusted only once auth_table checked it.
+	if h.AuthUserHeader != "" {
+		req.Header.Del(h.AuthUserHeader)
+		if h.userchecker != nil && ri.AuthUserInfo.Username != "" {
+			req.Header.Set(h.AuthUserHeader, ri.AuthUserInfo.Username)
+		}
+	}
+	if h.AuthUserSecret != "" {
+		name := cmp.Or(h.AuthSignatureHeader, "x-auth-signature")
+		req.Header.Del(name)
+		if h.userchecker != nil && ri.AuthUserInfo.Username != "" {
+			req.Header.Set(name, authUserSignature(h.AuthUserSecret, ri.AuthUserInfo.Username, time.Now().Unix()))
+		}
+	}
+	for attr, name := range h.AuthUserAttrHeaders {
+		req.Header.Del(name)
+		if value := ri.AuthUserInfo.Attrs[attr]; h.userchecker != nil && value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
 	if protocol := req.Header.Get(":protocol"); protocol != "" && req.ProtoMajor == 2 && req.Method == http.MethodConnect && req.RequestURI[0] == '/' {
-		switch protocol {
-		case "websocket":
-			break
-		default:
-			http.Error(rw, "pesudo protocol "+protocol+" is not supportted", http.StatusBadGateway)
-			return
+		h.extendedConnect(rw, req, ri, proxypass, protocol)
+		return
+	}
+
+	tr := h.transport(req, proxypass)
+
+	if prefix := h.StripPrefix; prefix != "" {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
+		req.RequestURI = strings.TrimPrefix(req.RequestURI, prefix)
+	}
+
+	if h.rewritepath != nil {
+		// rewrite the escaped form, so encoded segments like %2F survive the rewriting
+		path := h.rewritepath.ReplaceAllString(req.URL.EscapedPath(), h.rewriteto)
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			req.URL.Path, req.URL.RawPath = unescaped, path
+			req.RequestURI = req.URL.RequestURI()
+		} else {
+			log.Warn().Err(err).Context(ri.LogContext).Str("rewrite_path", path).Msg("proxy_pass rewrite path error")
 		}
-		hostport := proxypass.Host
-		if _, _, err := net.SplitHostPort(hostport); err != nil {
-			port := "80"
-			if proxypass.Scheme == "https" {
-				port = "443"
-			}
-			hostport = net.JoinHostPort(hostport, port)
+	}
+
+	// a proxypass path ending with "*" prefixes the client path, e.g. http://backend/v2/* proxies
+	// /foo?a=1 to /v2/foo?a=1 and a proxypass query is put before the client one, other paths are ignored.
+	if prefix, ok := strings.CutSuffix(proxypass.EscapedPath(), "*"); ok {
+		path, query := strings.TrimSuffix(prefix, "/")+req.URL.EscapedPath(), req.URL.RawQuery
+		if proxypass.RawQuery != "" && query != "" {
+			query = proxypass.RawQuery + "&" + query
+		} else {
+			query = cmp.Or(proxypass.RawQuery, query)
+		}
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			req.URL.Path, req.URL.RawPath, req.URL.RawQuery = unescaped, path, query
+			req.RequestURI = req.URL.RequestURI()
+		} else {
+			log.Warn().Err(err).Context(ri.LogContext).Str("proxypass", proxypass.String()).Msg("proxy_pass path error")
 		}
+	}
 
-		// conn, err := net.DialTimeout("tcp", hostport, time.Duration(cmp.Or(h.DialTimeout, 5))*time.Second)
-		conn, err := h.Transport.DialContext(req.Context(), "tcp", hostport)
-		if err != nil {
-			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 connect proxypass error")
-			http.Error(rw, err.Error(), http.StatusBadGateway)
+	h.forwardHeaders(req, ri, st)
+
+	if h.SetHeaders != "" {
+		if err := h.setHeaders(req, ri); err != nil {
+			log.Error().Context(ri.LogContext).Err(err).Str("req_host", req.Host).Str("req_url", req.URL.String()).Msg("proxy_pass set_headers template error")
+			http.Error(rw, "502 Bad Gateway: set_headers template error", http.StatusBadGateway)
 			return
 		}
-		defer conn.Close()
+	}
 
-		if proxypass.Scheme == "https" {
-			tlsConn := tls.Client(conn, h.Transport.TLSClientConfig)
-			err := tlsConn.HandshakeContext(req.Context())
-			if err != nil {
-				http.Error(rw, err.Error(), http.StatusBadGateway)
-				return
-			}
-			conn = tlsConn
-		}
+	if req.TLS != nil && req.TLS.ServerName != "" && strings.HasPrefix(req.Host, "127.") {
+		req.Host = req.TLS.ServerName
+	}
 
-		wskey := AppendableBytes(make([]byte, 0, 128)).Uint64(uint64(fastrandn(1<<32-1)), 16).Uint64(uint64(fastrandn(1<<32-1)), 16)
+	if req.ProtoAtLeast(3, 0) && req.Method == http.MethodGet {
+		req.Body, req.ContentLength = nil, 0
+	}
 
-		b := AppendableBytes(make([]byte, 0, 1024))
-		b = b.Str("GET ").Str(req.RequestURI).Str(" HTTP/1.1\r\n")
-		for key, values := range req.Header {
-			for _, value := range values {
-				if strings.HasPrefix(key, ":") {
-					continue
-				}
-				b = b.Str(key).Str(": ").Str(value).Str("\r\n")
-			}
+	// slow-loris bodies, upgraded connections are not bounded as their request bodies are streams
+	if (h.RequestBodyReadTimeout > 0 || h.MinRequestBodyRate > 0) && req.Body != nil && req.Body != http.NoBody && req.Header.Get("upgrade") == "" {
+		req.Body = &slowBodyReader{
+			ReadCloser: req.Body,
+			rc:         http.NewResponseController(rw),
+			timeout:    h.RequestBodyReadTimeout,
+			minRate:    h.MinRequestBodyRate,
+			start:      time.Now(),
 		}
-		b = b.Str("Sec-WebSocket-Key: ").Base64(wskey).Str("\r\n")
-		b = b.Str("Upgrade: ").Str(req.Header.Get(":protocol")).Str("\r\n")
-		b = b.Str("Host: ").Str(req.Host).Str("\r\n")
-		b = b.Str("Connection: Upgrade\r\n")
-		b = b.Str("\r\n")
+	}
 
-		_, err = conn.Write(b)
-		if err != nil {
-			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 write to proxypass error")
-			http.Error(rw, err.Error(), http.StatusBadGateway)
+	if h.BufferRequestBody && req.Body != nil && req.Body != http.NoBody {
+		if err := h.bufferRequestBody(req); err != nil {
+			log.Warn().Err(err).Context(ri.LogContext).Int64("http_content_length", req.ContentLength).Msg("proxy_pass buffer request body error")
+			http.Error(rw, "400 Bad Request", http.StatusBadRequest)
 			return
 		}
+	}
 
-		br := bufio.NewReader(conn)
-		resp, err := http.ReadResponse(br, req)
-		if err != nil {
-			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 read from proxypass error")
-			http.Error(rw, err.Error(), http.StatusBadGateway)
-			return
+	var span *HTTPTraceSpan
+	if h.TracePropagation || h.Tracer != nil {
+		span = NewHTTPTraceSpan(req.Header.Get("traceparent"), req.Header.Get("tracestate"))
+		span.Method = req.Method
+		span.Upstream = req.URL.String()
+		req.Header.Set("traceparent", span.Traceparent())
+		if span.TraceState != "" {
+			req.Header.Set("tracestate", span.TraceState)
+		}
+		if h.Tracer != nil {
+			req = req.WithContext(h.Tracer.Start(req.Context(), span))
+			defer h.Tracer.End(span)
 		}
+	}
+
+	var tap *webProxyTap
+	if h.tapper != nil && (h.TapSampleRate >= 1 || float64(fastrandn(1<<24)) < h.TapSampleRate*(1<<24)) {
+		limit := cmp.Or(h.TapMaxBytes, 64*1024)
+		tap = &webProxyTap{ReqBody: tapBuffer{Limit: limit}, RespBody: tapBuffer{Limit: limit}}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(req.Body, &tap.ReqBody), req.Body}
+		}
+		defer h.writeTap(tap, req, ri)
+	}
 
-		log.Info().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("hostport", hostport).Int("resp_statuscode", resp.StatusCode).Object("resp_header", HTTPHeaderMarshalLogObject(resp.Header)).Msg("http2 get response ok")
+	if h.mirrorpass != nil && (h.MirrorSampleRate >= 1 || float64(fastrandn(1<<24)) < h.MirrorSampleRate*(1<<24)) {
+		h.mirror(req, ri)
+	}
+
+	var metrics *expvar.Map
+	if h.MetricsRegistry != nil {
+		metrics = h.MetricsRegistry.Upstream(proxypass.Host)
+		metrics.Add("requests", 1)
+		metrics.Add("inflight", 1)
+		defer metrics.Add("inflight", -1)
+	}
 
-		if resp.StatusCode != http.StatusSwitchingProtocols {
-			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Int("resp_statuscode", resp.StatusCode).Msg("http2 swtich 101 from proxypass error")
-			http.Error(rw, "switch protocols failed, resp statuscode: "+strconv.Itoa(resp.StatusCode), http.StatusBadGateway)
+	if h.breakers != nil && breaker == nil {
+		var ok bool
+		if breaker, ok = h.allowTarget(proxypass.Host); !ok {
+			breaker = nil
+			if metrics != nil {
+				metrics.Add("circuit_breaker_rejects", 1)
+			}
+			http.Error(rw, "503 Service Unavailable", http.StatusServiceUnavailable)
 			return
 		}
+	}
 
-		for key, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(key, value)
+	if timeout := h.timeout(req, ri); timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	// the trace is only wired when someone reads it, GotConn runs once per attempt of the round trip
+	if metrics != nil || h.AccessLog && slices.Contains(h.AccessLogFields, "conn_reused") {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				st.Reused = info.Reused
+				if metrics == nil {
+					return
+				}
+				if info.Reused {
+					metrics.Add("conn_reused", 1)
+				} else {
+					metrics.Add("conn_new", 1)
+				}
+			},
+		}))
+	}
+
+	// relay informational responses such as 103 early hints when enabled, http/1.0 clients cannot receive them
+	// and 100 continue is answered by the server itself.
+	if h.EarlyHints && req.ProtoAtLeast(1, 1) {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusContinue {
+					return nil
+				}
+				// the headers already set for the final response must not leak into the 1xx response
+				final := rw.Header().Clone()
+				clear(rw.Header())
+				maps.Copy(rw.Header(), http.Header(header))
+				rw.WriteHeader(code)
+				clear(rw.Header())
+				maps.Copy(rw.Header(), final)
+				return nil
+			},
+		}))
+	}
+
+	start := time.Now()
+	resp, err := h.roundTrip(tr, req, ri)
+	switch {
+	case breaker == nil:
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// the client went away, which tells nothing about the upstream, the deferred release gives back the probe
+	default:
+		recorded = true
+		failed := err != nil || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		if breaker.Record(time.Now(), failed, h.CircuitBreakerThreshold, cmp.Or(h.CircuitBreakerWindow, time.Minute)) {
+			log.Warn().Err(err).Context(ri.LogContext).Str("upstream", proxypass.Host).Int("circuit_breaker_threshold", h.CircuitBreakerThreshold).Msg("proxy_pass circuit breaker open")
+			if metrics != nil {
+				metrics.Add("circuit_breaker_trips", 1)
+			}
+		}
+	}
+	if metrics != nil {
+		h.MetricsRegistry.Observe(metrics, time.Since(start), resp, err)
+	}
+	if span != nil {
+		span.Err = err
+		if resp != nil {
+			span.StatusCode = resp.StatusCode
+		}
+	}
+	if err != nil && h.DefaultPass != "" && !fallback && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		// an unreachable upstream never got the request, so it is safe to send it to default_pass
+		if class := webProxyErrorClass(err); class == "dns" || class == "refused" {
+			log.Warn().Err(err).Context(ri.LogContext).Str("req_host", req.Host).Str("error_class", class).Str("default_pass", h.DefaultPass).Msg("proxy_pass upstream unreachable, fall back to default_pass")
+			if h.defaultpass == nil {
+				status, _ := parseProxyPassStatus(h.DefaultPass)
+				status.ServeHTTP(rw, req)
+				return
+			}
+			if req.GetBody != nil {
+				req.Body, _ = req.GetBody()
+			}
+			req.URL.Scheme, req.URL.Host, req.Host = h.defaultpass.Scheme, h.defaultpass.Host, h.defaultpass.Host
+			st.Upstream = h.defaultpass.Host
+			resp, err = h.roundTrip(h.Transport, req, ri)
+		}
+	}
+	if err != nil {
+		class := webProxyErrorClass(err)
+		code, ok := h.ErrorStatusCodes[class]
+		if !ok {
+			code = defaultWebProxyErrorStatusCodes[class]
+		}
+		log.Warn().Err(err).Context(ri.LogContext).Str("req_host", req.Host).Str("req_url", req.URL.String()).Str("error_class", class).Int("http_status", code).Msg("proxypass error")
+		http.Error(rw, strconv.Itoa(code)+" "+http.StatusText(code), code)
+		return
+	}
+
+	if len(h.LogResponseHeaders) != 0 {
+		// e.g. x-backend-server is logged as upstream_x_backend_server in the following log lines
+		ctx := log.NewContext(ri.LogContext)
+		for _, name := range h.LogResponseHeaders {
+			if value := resp.Header.Get(name); value != "" {
+				ctx = ctx.Str("upstream_"+strings.ReplaceAll(strings.ToLower(name), "-", "_"), value)
 			}
 		}
-		rw.WriteHeader(http.StatusOK)
+		ri.LogContext = ctx.Value()
+	}
 
-		rwc := HTTPRequestStream{req.Body, rw, http.NewResponseController(rw), net.TCPAddrFromAddrPort(ri.RemoteAddr), net.TCPAddrFromAddrPort(ri.ServerAddr)}
-		defer rwc.Close()
+	if tap != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		tap.Resp = resp
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(resp.Body, &tap.RespBody), resp.Body}
+	}
 
-		go io.Copy(rwc, br)
-		io.Copy(conn, rwc)
+	e := log.Info().Context(ri.LogContext).Int("http_status", resp.StatusCode).Int64("http_content_length", resp.ContentLength)
+	if h.LogGeoIP {
+		// ri.GeoIPInfo is resolved once per request by HTTPServerHandler, empty fields mean the lookup failed
+		if ri.GeoIPInfo.Country != "" {
+			e = e.Str("geoip_country", ri.GeoIPInfo.Country)
+		}
+		if ri.GeoIPInfo.ASN != "" {
+			e = e.Str("geoip_asn", ri.GeoIPInfo.ASN)
+		}
+		if ri.GeoIPInfo.ISP != "" {
+			e = e.Str("geoip_org", ri.GeoIPInfo.ISP)
+		}
+	}
+	e.Msg("proxy_pass request")
 
+	if location := resp.Header.Get("x-accel-redirect"); location != "" && st.Origin != nil {
+		resp.Body.Close()
+		u, err := url.Parse(location)
+		if err != nil || st.Redirects >= webProxyMaxAccelRedirects {
+			log.Error().Err(err).Context(ri.LogContext).Str("x_accel_redirect", location).Int("depth", st.Redirects).Msg("proxy_pass x-accel-redirect error")
+			http.Error(rw, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		log.Info().Context(ri.LogContext).Str("x_accel_redirect", location).Int("depth", st.Redirects).Msg("proxy_pass x-accel-redirect")
+		st.Redirects++
+		// the proxy step rewrites req, keep another pristine copy for the next hop
+		req, st.Origin = st.Origin, st.Origin.Clone(st.Origin.Context())
+		if req.Method != http.MethodHead {
+			req.Method = http.MethodGet
+		}
+		req.Body, req.ContentLength = http.NoBody, 0
+		req.Header.Del("content-length")
+		req.Header.Del("content-type")
+		req.URL.Path, req.URL.RawPath, req.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+		req.RequestURI = req.URL.RequestURI()
+		h.proxy(rw, req, ri, st)
 		return
 	}
 
-	var tr http.RoundTripper
-	switch proxypass.Scheme {
-	case "http3":
-		tr = h.h3transport
-		req.URL.Scheme = "https"
-		req.URL.Host = proxypass.Host
-		req.Host = proxypass.Host
-	default:
-		tr = h.Transport
-		req.URL.Scheme = proxypass.Scheme
-		req.URL.Host = proxypass.Host
-		req.Host = proxypass.Host
+	h.copyResponse(rw, req, resp, ri, st, proxypass)
+}
+
+// forwardHeaders sets the forwarding, fingerprint and client identity headers of req for upstream.
+func (h *HTTPWebProxyHandler) forwardHeaders(req *http.Request, ri *HTTPRequestInfo, st *webProxyState) {
+	if name := h.forwardedfor; name != "" {
+		if s := req.Header.Get(name); s != "" {
+			req.Header.Set(name, s+", "+ri.RemoteAddr.Addr().String())
+		} else {
+			req.Header.Set(name, ri.RemoteAddr.Addr().String())
+		}
+	}
+	if name := h.realip; name != "" {
+		req.Header.Set(name, ri.RealIP.String())
 	}
 
-	if prefix := h.StripPrefix; prefix != "" {
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, prefix)
-		req.RequestURI = strings.TrimPrefix(req.RequestURI, prefix)
+	if h.Via != "" {
+		req.Header.Add("via", viaProtocol(req.ProtoMajor, req.ProtoMinor)+" "+h.Via)
 	}
 
-	if s := req.Header.Get("x-forwarded-for"); s != "" {
-		req.Header.Set("x-forwarded-for", s+", "+ri.RemoteAddr.Addr().String())
-	} else {
-		req.Header.Set("x-forwarded-for", ri.RemoteAddr.Addr().String())
+	if h.Forwarded {
+		// only a trusted downstream proxy may extend the chain, the value of a client is dropped
+		var forwarded string
+		if h.trustedDownstream(ri) {
+			forwarded = strings.Join(req.Header.Values("forwarded"), ", ")
+		}
+		req.Header.Set("forwarded", forwardedElement(forwarded, ri, st.Host))
+	}
+
+	if h.ForwardHost || h.ForwardPort {
+		// keep values set by a trusted downstream proxy
+		trusted := h.trustedDownstream(ri)
+		if h.ForwardHost && (!trusted || req.Header.Get("x-forwarded-host") == "") {
+			req.Header.Set("x-forwarded-host", st.Host)
+		}
+		if h.ForwardPort && ri.ServerAddr.IsValid() && (!trusted || req.Header.Get("x-forwarded-port") == "") {
+			req.Header.Set("x-forwarded-port", strconv.Itoa(int(ri.ServerAddr.Port())))
+		}
 	}
-	req.Header.Set("x-real-ip", ri.RealIP.String())
 
+	// fingerprint headers are only ever set by the proxy, so clients cannot forge them
+	if h.ForwardJA4 {
+		req.Header.Del("x-ja4")
+	}
+	if h.ForwardALPN {
+		req.Header.Del("x-alpn")
+	}
+	if h.ForwardJA4H {
+		req.Header.Del("x-ja4h")
+	}
 	if ri.TLSVersion != 0 {
-		req.Header.Set("x-forwarded-proto", "https")
+		if !h.DisableForwardedProto {
+			req.Header.Set("x-forwarded-proto", "https")
+		}
 		// req.Header.Set("x-forwarded-ssl", "on")
 		// req.Header.Set("x-url-scheme", "https")
 		// req.Header.Set("x-http-proto", req.Proto)
-		// req.Header.Set("x-ja4", string(ri.JA4))
+		if h.ForwardJA4 && ri.JA4 != "" {
+			req.Header.Set("x-ja4", ri.JA4)
+		}
+		if h.ForwardALPN && req.TLS != nil && req.TLS.NegotiatedProtocol != "" {
+			req.Header.Set("x-alpn", req.TLS.NegotiatedProtocol)
+		}
+	}
+	if st.JA4H != "" {
+		req.Header.Set("x-ja4h", st.JA4H)
 	}
+}
 
-	if h.SetHeaders != "" {
-		h.setHeaders(req, ri)
+var defaultWebProxyAccessLogFields = []string{"method", "path", "status", "bytes", "duration", "upstream", "remote_ip", "ja4", "user_agent", "username"}
+
+func (h *HTTPWebProxyHandler) accessLog(method, path string, start time.Time, cw *HTTPCountingResponseWriter, upstream *string, reused *bool, ri *HTTPRequestInfo) {
+	fields := h.AccessLogFields
+	if len(fields) == 0 {
+		fields = defaultWebProxyAccessLogFields
 	}
 
-	if req.TLS != nil && req.TLS.ServerName != "" && strings.HasPrefix(req.Host, "127.") {
-		req.Host = req.TLS.ServerName
+	e := log.Info().Context(ri.LogContext)
+	for _, field := range fields {
+		switch field {
+		case "method":
+			e = e.Str("method", method)
+		case "path":
+			e = e.Str("path", path)
+		case "status":
+			e = e.Int("status", cw.Status)
+		case "bytes":
+			e = e.Int64("bytes", cw.Bytes)
+		case "duration":
+			e = e.Dur("duration", time.Since(start))
+		case "upstream":
+			e = e.Str("upstream", *upstream)
+		case "conn_reused":
+			e = e.Bool("conn_reused", *reused)
+		case "remote_ip":
+			e = e.NetIPAddr("remote_ip", ri.RealIP)
+		case "ja4":
+			e = e.Str("ja4", ri.JA4)
+		case "user_agent":
+			e = e.Str("user_agent", ri.UserAgent.String)
+		case "username":
+			e = e.Str("username", ri.AuthUserInfo.Username)
+		}
 	}
+	e.Msg("web proxy access")
+}
 
-	if req.ProtoAtLeast(3, 0) && req.Method == http.MethodGet {
-		req.Body, req.ContentLength = nil, 0
+// HTTPWebProxyDeny is a first line of bot mitigation, a request matches any of the rules is denied.
+type HTTPWebProxyDeny struct {
+	JA4            []string      // glob patterns of ja4
+	UserAgentBot   bool          // the user agent is a known bot
+	UserAgentNames []string      // names of user agent, e.g. curl
+	CIDRs          []string      // client ip ranges
+	Status         int           // response status code, 403 by default, 444 closes the connection
+	Tarpit         time.Duration // delay before responding
+}
+
+// parsePrefixes parses a list of cidrs or ip addresses.
+func parsePrefixes(cidrs []string) (prefixes []netip.Prefix, err error) {
+	for _, s := range cidrs {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return
+}
+
+func (h *HTTPWebProxyHandler) denied(ri *HTTPRequestInfo) bool {
+	if ja4match(ri.JA4, h.Deny.JA4...) {
+		return true
 	}
+	if h.Deny.UserAgentBot && ri.UserAgent.Bot {
+		return true
+	}
+	if ri.UserAgent.Name != "" && slices.ContainsFunc(h.Deny.UserAgentNames, func(name string) bool { return strings.EqualFold(name, ri.UserAgent.Name) }) {
+		return true
+	}
+	for _, prefix := range h.denycidrs {
+		if prefix.Contains(ri.RealIP) {
+			return true
+		}
+	}
+	return false
+}
 
-	resp, err := tr.RoundTrip(req)
+// ja4match reports whether ja4 matches any of the glob patterns, e.g. {{ if ja4match .JA4 "t13d*" }},
+// an empty ja4 of plain http requests never matches.
+func ja4match(ja4 string, patterns ...string) bool {
+	if ja4 == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if WildcardMatch(pattern, ja4) {
+			return true
+		}
+	}
+	return false
+}
+
+// cookie returns the value of the named request cookie, or empty if absent, e.g. {{ cookie "session" .Request }}.
+// all cookie headers are parsed, and double quotes around a value are removed as RFC 6265.
+func cookie(name string, req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	c, err := req.Cookie(name)
 	if err != nil {
-		log.Warn().Err(err).Context(ri.LogContext).Str("req_host", req.Host).Str("req_url", req.URL.String()).Msg("proxypass error")
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || os.IsTimeout(err) {
-			http.Error(rw, "504 Gateway Timeout", http.StatusGatewayTimeout)
-		} else {
-			http.Error(rw, "502 Bad Gateway", http.StatusBadGateway)
+		return ""
+	}
+	return c.Value
+}
+
+// authUserSignature signs the forwarded username as "t=<unix time>,v1=<hex hmac-sha256 of user.t>",
+// upstreams verify it with the shared secret and reject stale timestamps to bound replays.
+func authUserSignature(secret, user string, t int64) string {
+	ts := strconv.FormatInt(t, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(user + "." + ts))
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// connect tunnels a CONNECT request to the requested host:port, as a forward proxy.
+func (h *HTTPWebProxyHandler) connect(rw http.ResponseWriter, req *http.Request, ri *HTTPRequestInfo) {
+	hostport := req.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "443")
+	}
+
+	conn, err := h.Transport.DialContext(h.withDialPolicy(req.Context()), "tcp", hostport)
+	if err != nil {
+		log.Error().Context(ri.LogContext).Err(err).Str("hostport", hostport).Msg("web proxy connect dial error")
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	log.Info().Context(ri.LogContext).Str("hostport", hostport).Str("username", ri.AuthUserInfo.Username).Msg("web proxy connect ok")
+
+	if req.ProtoMajor == 1 {
+		lconn, lbrw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			log.Error().Context(ri.LogContext).Err(err).Str("hostport", hostport).Msg("web proxy connect hijack error")
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer lconn.Close()
+
+		if _, err := lconn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
 		}
+		h.bridge(lconn, lbrw, conn, conn)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(rw)
+	if err := rc.Flush(); err != nil {
 		return
 	}
 
-	log.Info().Context(ri.LogContext).Int("http_status", resp.StatusCode).Int64("http_content_length", resp.ContentLength).Msg("proxy_pass request")
+	rwc := HTTPRequestStream{req.Body, rw, rc, net.TCPAddrFromAddrPort(ri.RemoteAddr), net.TCPAddrFromAddrPort(ri.ServerAddr)}
+	defer rwc.Close()
 
-	if req.ProtoAtLeast(2, 0) {
-		resp.Header.Del("connection")
-		resp.Header.Del("keep-alive")
+	h.bridge(rwc, rwc, conn, conn)
+}
+
+// acquire takes a slot of MaxConcurrent, waiting up to QueueTimeout in a queue of MaxQueue.
+func (h *HTTPWebProxyHandler) acquire(ctx context.Context) bool {
+	select {
+	case h.sem <- struct{}{}:
+		return true
+	default:
 	}
 
-	if h.DumpFailure && resp.StatusCode >= http.StatusBadRequest {
-		data, err := httputil.DumpResponse(resp, true)
-		if err != nil {
-			log.Warn().Err(err).Context(ri.LogContext).Int("status", resp.StatusCode).Int64("content_length", resp.ContentLength).Msg("DumpFailureResponse error")
-		} else {
-			log.Info().Context(ri.LogContext).Int("status", resp.StatusCode).Int64("content_length", resp.ContentLength).Str("data", string(data)).Msg("DumpFailureResponse ok")
+	if h.MaxQueue < 0 {
+		return false
+	}
+	if h.queued.Add(1) > int64(cmp.Or(h.MaxQueue, h.MaxConcurrent)) {
+		h.queued.Add(-1)
+		return false
+	}
+	defer h.queued.Add(-1)
+
+	timer := time.NewTimer(cmp.Or(h.QueueTimeout, time.Second))
+	defer timer.Stop()
+
+	select {
+	case h.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// health answers the health path, with the circuit breaker state of upstreams if enabled.
+func (h *HTTPWebProxyHandler) health(rw http.ResponseWriter, req *http.Request) {
+	status, code := "ok", http.StatusOK
+	if h.draining.Load() {
+		status, code = "draining", http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("cache-control", "no-store")
+	if h.breakers == nil {
+		rw.Header().Set("content-type", "text/plain; charset=utf-8")
+		rw.WriteHeader(code)
+		if req.Method != http.MethodHead {
+			io.WriteString(rw, status+"\n")
 		}
+		return
 	}
 
-	if resp.StatusCode == http.StatusSwitchingProtocols {
-		conn, ok := resp.Body.(io.ReadWriteCloser)
-		if !ok {
-			http.Error(rw, "internal error: 101 switching protocols response with non-writable body", 500)
-			return
+	upstreams := make(map[string]string)
+	h.breakers.Range(func(upstream string, breaker *webProxyBreaker) bool {
+		upstreams[upstream] = "up"
+		if breaker.Opened() {
+			upstreams[upstream] = "down"
 		}
-		defer conn.Close()
+		return true
+	})
 
-		for k, vv := range resp.Header {
-			for _, v := range vv {
-				rw.Header().Add(k, v)
-			}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(code)
+	if req.Method != http.MethodHead {
+		json.NewEncoder(rw).Encode(map[string]any{
+			"status":    status,
+			"upstreams": upstreams,
+		})
+	}
+}
+
+// challenge adds a www-authenticate header per AuthChallenges scheme, Basic only by default.
+// an item with parameters, e.g. `Bearer realm="api", scope="read"`, is sent as is. Digest is refused by Load,
+// as the auth table only verifies Basic credentials.
+func (h *HTTPWebProxyHandler) challenge(rw http.ResponseWriter) {
+	schemes := h.AuthChallenges
+	if len(schemes) == 0 {
+		schemes = []string{"Basic"}
+	}
+	for _, scheme := range schemes {
+		switch {
+		case strings.ContainsRune(scheme, ' '):
+			rw.Header().Add("www-authenticate", scheme)
+		default:
+			rw.Header().Add("www-authenticate", scheme+` realm="`+h.AuthBasic+`"`)
 		}
-		rw.WriteHeader(resp.StatusCode)
+	}
+}
 
-		lconn, flusher, err := http.NewResponseController(rw).Hijack()
-		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadGateway)
+// trustedDownstream reports whether the client is a downstream proxy whose forwarded headers are trusted,
+// that is a loopback or TrustedProxyIPs tcp peer. the proxy-authorization username is never verified
+// here, so it does not make a client trusted.
+func (h *HTTPWebProxyHandler) trustedDownstream(ri *HTTPRequestInfo) bool {
+	addr := ri.RemoteAddr.Addr().Unmap()
+	return addr.IsLoopback() || slices.ContainsFunc(h.trustcidrs, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// webProxyTap captures the bodies of a sampled request, the proxied streams are untouched.
+type webProxyTap struct {
+	Resp     *http.Response
+	ReqBody  tapBuffer
+	RespBody tapBuffer
+}
+
+// tapBuffer keeps the first Limit bytes written, and counts the rest.
+type tapBuffer struct {
+	B     []byte
+	N     int64
+	Limit int
+}
+
+func (b *tapBuffer) Write(p []byte) (int, error) {
+	if n := b.Limit - len(b.B); n > 0 {
+		b.B = append(b.B, p[:min(n, len(p))]...)
+	}
+	b.N += int64(len(p))
+	return len(p), nil
+}
+
+func (h *HTTPWebProxyHandler) writeTap(tap *webProxyTap, req *http.Request, ri *HTTPRequestInfo) {
+	e := h.tapper.Log().
+		Xid("trace_id", ri.TraceID).
+		Str("method", req.Method).
+		Str("url", req.URL.String()).
+		Object("req_header", HTTPHeaderMarshalLogObject(h.redact(req.Header))).
+		Str("req_body", b2s(tap.ReqBody.B)).
+		Int64("req_body_bytes", tap.ReqBody.N)
+	if resp := tap.Resp; resp != nil {
+		e = e.Int("status", resp.StatusCode).
+			Object("resp_header", HTTPHeaderMarshalLogObject(h.redact(resp.Header))).
+			Str("resp_body", b2s(tap.RespBody.B)).
+			Int64("resp_body_bytes", tap.RespBody.N)
+	}
+	e.Msg("")
+}
+
+// mirror sends a copy of req to the rendered MirrorPass in background, the response is discarded.
+// the request body is buffered for the copy, requests with a body over 1MB are not mirrored.
+func (h *HTTPWebProxyHandler) mirror(req *http.Request, ri *HTTPRequestInfo) {
+	const maxBodySize = 1 << 20
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+		if err != nil || len(data) > maxBodySize {
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
 			return
 		}
-		defer lconn.Close()
-		if err := flusher.Flush(); err != nil {
-			http.Error(rw, fmt.Sprintf("response flush: %v", err), 500)
+		body = data
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{bytes.NewReader(body), req.Body}
+	}
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	if err := h.execute(h.mirrorpass, bb, req, nil, ri); err != nil {
+		log.Warn().Err(err).Context(ri.LogContext).Str("mirror_pass", h.MirrorPass).Msg("mirror_pass execute error")
+		return
+	}
+	mirrorpass, err := url.Parse(strings.TrimSpace(bb.String()))
+	if err != nil || mirrorpass.Host == "" {
+		log.Warn().Err(err).Context(ri.LogContext).Str("mirror_pass", bb.String()).Msg("mirror_pass parse error")
+		return
+	}
+
+	// the mirror request outlives the client request, it must never affect the client.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), time.Minute)
+	mreq := req.Clone(ctx)
+	mreq.URL.Scheme = mirrorpass.Scheme
+	mreq.URL.Host = mirrorpass.Host
+	mreq.Host = mirrorpass.Host
+	mreq.Body = nil
+	if body != nil {
+		mreq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// ri is recycled once the client request finished
+	logctx := slices.Clone(ri.LogContext)
+	go func() {
+		defer cancel()
+		resp, err := h.Transport.RoundTrip(mreq)
+		if err != nil {
+			log.Warn().Err(err).Context(logctx).Str("mirror_url", mreq.URL.String()).Msg("mirror_pass request error")
 			return
 		}
+		defer resp.Body.Close()
+		n, _ := io.Copy(io.Discard, resp.Body)
+		log.Debug().Context(logctx).Str("mirror_url", mreq.URL.String()).Int("http_status", resp.StatusCode).Int64("resp_body_bytes", n).Msg("mirror_pass request ok")
+	}()
+}
 
-		go io.Copy(lconn, conn)
-		io.Copy(conn, lconn)
-	} else {
-		if location := resp.Header.Get("location"); location != "" {
-			prefix := "http://" + req.Host + "/"
-			if strings.HasPrefix(location, prefix) && ri.TLSVersion != 0 {
-				resp.Header.Set("location", location[len(prefix)-1:])
-			}
+func (h *HTTPWebProxyHandler) execute(tmpl *template.Template, wr io.Writer, req *http.Request, resp *http.Response, ri *HTTPRequestInfo) error {
+	if obfuscated {
+		return tmpl.Execute(wr, map[string]any{
+			"Request":         req,
+			"Response":        resp,
+			"RealIP":          ri.RealIP,
+			"RemoteAddr":      ri.RemoteAddr,
+			"ClientHelloInfo": ri.ClientHelloInfo,
+			"TLSVersion":      ri.TLSVersion,
+			"JA4":             ri.JA4,
+			"UserAgent":       &ri.UserAgent,
+			"Username":        ri.AuthUserInfo.Username,
+			"ServerAddr":      ri.ServerAddr,
+		})
+	}
+	return tmpl.Execute(wr, struct {
+		Request         *http.Request
+		Response        *http.Response
+		RealIP          netip.Addr
+		RemoteAddr      netip.AddrPort
+		ClientHelloInfo *tls.ClientHelloInfo
+		TLSVersion      uint16
+		JA4             string
+		UserAgent       *useragent.UserAgent
+		Username        string
+		ServerAddr      netip.AddrPort
+	}{
+		Request:         req,
+		Response:        resp,
+		RealIP:          ri.RealIP,
+		RemoteAddr:      ri.RemoteAddr,
+		ClientHelloInfo: ri.ClientHelloInfo,
+		TLSVersion:      ri.TLSVersion,
+		JA4:             ri.JA4,
+		UserAgent:       &ri.UserAgent,
+		Username:        ri.AuthUserInfo.Username,
+		ServerAddr:      ri.ServerAddr,
+	})
+}
+
+func (h *HTTPWebProxyHandler) setHeaders(req *http.Request, ri *HTTPRequestInfo) error {
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	// a partially rendered template is not applied
+	if err := h.renderHeaders(bb, req, ri); err != nil {
+		return err
+	}
+	if host := applyHeaders(bb.B, req.Header); host != "" {
+		// req.URL.Host = value
+		req.Host = host
+	}
+	return nil
+}
+
+func (h *HTTPWebProxyHandler) renderHeaders(bb *bytebufferpool.ByteBuffer, req *http.Request, ri *HTTPRequestInfo) error {
+	bb.Reset()
+	if h.headers != nil {
+		return h.execute(h.headers, bb, req, nil, ri)
+	}
+	bb.WriteString(h.SetHeaders)
+	return nil
+}
+
+// applyHeaders applies the "key: value" lines of set_headers to header, and returns the value of host key if any.
+func applyHeaders(headers []byte, header http.Header) (host string) {
+	for line := range strings.Lines(b2s(headers)) {
+		// split on the first colon only, values like "http://x:8080/" or "12:30" keep their colons
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
 		}
-		for key, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(key, value)
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if key == "" {
+			continue
+		}
+		if strings.EqualFold(key, "host") {
+			host = value
+		}
+		// a leading "+" appends the value instead of replacing, e.g. "+x-foo: bar"
+		if key[0] == '+' {
+			if key = strings.TrimSpace(key[1:]); key != "" {
+				header.Add(key, value)
 			}
+			continue
 		}
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		io.Copy(rw, resp.Body)
+		header.Set(key, value)
 	}
+	return
 }
 
-func (h *HTTPWebProxyHandler) setHeaders(req *http.Request, ri *HTTPRequestInfo) {
-	var headers string
-	if h.headers != nil {
-		bb := bytebufferpool.Get()
-		defer bytebufferpool.Put(bb)
-		bb.Reset()
-		if obfuscated {
-			h.headers.Execute(bb, map[string]any{
-				"Request":         req,
-				"RealIP":          ri.RealIP,
-				"ClientHelloInfo": ri.ClientHelloInfo,
-				"JA4":             ri.JA4,
-				"UserAgent":       &ri.UserAgent,
-				"ServerAddr":      ri.ServerAddr,
-			})
+// HTTPWebProxyTracer receives a span around each proxied request, embedders plug their exporters here.
+type HTTPWebProxyTracer interface {
+	// Start is called before the upstream round trip, the returned context is used for the outbound request.
+	Start(ctx context.Context, span *HTTPTraceSpan) context.Context
+	// End is called once the response was relayed to client.
+	End(span *HTTPTraceSpan)
+}
+
+// HTTPTraceSpan is a W3C trace context span, see https://www.w3.org/TR/trace-context/
+type HTTPTraceSpan struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Flags        byte
+	TraceState   string
+	Method       string
+	Upstream     string
+	StatusCode   int
+	Err          error
+	Start        time.Time
+}
+
+// NewHTTPTraceSpan starts a child span of traceparent, or a new trace if traceparent is absent or invalid.
+func NewHTTPTraceSpan(traceparent, tracestate string) *HTTPTraceSpan {
+	span := &HTTPTraceSpan{
+		Flags: 0x01,
+		Start: time.Now(),
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(traceparent, "-")
+	if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" && (parts[0] != "00" || len(parts) == 4) &&
+		len(parts[1]) == 32 && len(parts[2]) == 16 && len(parts[3]) == 2 {
+		var flags [1]byte
+		_, err1 := hex.Decode(span.TraceID[:], s2b(parts[1]))
+		_, err2 := hex.Decode(span.ParentSpanID[:], s2b(parts[2]))
+		_, err3 := hex.Decode(flags[:], s2b(parts[3]))
+		if err1 == nil && err2 == nil && err3 == nil && span.TraceID != [16]byte{} && span.ParentSpanID != [8]byte{} {
+			span.Flags = flags[0]
+			span.TraceState = tracestate
 		} else {
-			h.headers.Execute(bb, struct {
-				Request         *http.Request
-				RealIP          netip.Addr
-				ClientHelloInfo *tls.ClientHelloInfo
-				JA4             string
-				UserAgent       *useragent.UserAgent
-				ServerAddr      netip.AddrPort
-			}{
-				Request:         req,
-				RealIP:          ri.RealIP,
-				ClientHelloInfo: ri.ClientHelloInfo,
-				JA4:             ri.JA4,
-				UserAgent:       &ri.UserAgent,
-				ServerAddr:      ri.ServerAddr,
-			})
-		}
-		headers = bb.String()
+			span.TraceID, span.ParentSpanID = [16]byte{}, [8]byte{}
+		}
+	}
+
+	if span.TraceID == [16]byte{} {
+		binary.BigEndian.PutUint64(span.TraceID[:8], fastrand64())
+		binary.BigEndian.PutUint64(span.TraceID[8:], fastrand64()|1)
+	}
+	binary.BigEndian.PutUint64(span.SpanID[:], fastrand64()|1)
+
+	return span
+}
+
+// Traceparent returns the traceparent header value which propagates the span to upstream.
+func (span *HTTPTraceSpan) Traceparent() string {
+	b := make([]byte, 0, 55)
+	b = append(b, "00-"...)
+	b = hex.AppendEncode(b, span.TraceID[:])
+	b = append(b, '-')
+	b = hex.AppendEncode(b, span.SpanID[:])
+	b = append(b, '-')
+	b = hex.AppendEncode(b, []byte{span.Flags})
+	return b2s(b)
+}
+
+// viaProtocol returns the received-protocol of a via entry, e.g. "1.1" or "2".
+func viaProtocol(major, minor int) string {
+	if major >= 2 {
+		return strconv.Itoa(major)
+	}
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor)
+}
+
+// forwardedElement appends a RFC 7239 forwarded-element describing this hop to the existing header value.
+func forwardedElement(forwarded string, ri *HTTPRequestInfo, host string) string {
+	b := make([]byte, 0, 128)
+	if forwarded != "" {
+		b = append(b, forwarded...)
+		b = append(b, ", "...)
+	}
+
+	node := func(addr netip.Addr) string {
+		if addr = addr.Unmap(); addr.Is6() {
+			return "[" + addr.String() + "]"
+		}
+		return addr.String()
+	}
+
+	b = appendForwardedPair(b, "for", node(ri.RemoteAddr.Addr()))
+	if ri.ServerAddr.IsValid() {
+		b = append(b, ';')
+		b = appendForwardedPair(b, "by", node(ri.ServerAddr.Addr())+":"+strconv.Itoa(int(ri.ServerAddr.Port())))
+	}
+	if host != "" {
+		b = append(b, ';')
+		b = appendForwardedPair(b, "host", host)
+	}
+	b = append(b, ';')
+	if ri.TLSVersion != 0 {
+		b = appendForwardedPair(b, "proto", "https")
 	} else {
-		headers = h.SetHeaders
+		b = appendForwardedPair(b, "proto", "http")
 	}
 
-	for line := range strings.Lines(headers) {
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
-			continue
+	return string(b)
+}
+
+// appendForwardedPair appends key=value, quoting the value unless it is a token.
+func appendForwardedPair(b []byte, key, value string) []byte {
+	b = append(b, key...)
+	b = append(b, '=')
+
+	token := value != ""
+	for _, c := range []byte(value) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			token = false
+			break
 		}
-		key, value := parts[0], strings.TrimSpace(parts[1])
-		switch key {
-		case "host", "Host", "HOST":
-			// req.URL.Host = value
-			req.Host = value
+	}
+	if token {
+		return append(b, value...)
+	}
+
+	b = append(b, '"')
+	for _, c := range []byte(value) {
+		if c == '"' || c == '\\' {
+			b = append(b, '\\')
 		}
-		req.Header.Set(key, value)
+		b = append(b, c)
 	}
+	return append(b, '"')
 }
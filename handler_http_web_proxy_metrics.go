@@ -0,0 +1,92 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webProxyMetrics publishes the metrics of every proxy route in /debug/vars, keyed by listen and location.
+var webProxyMetrics = expvar.NewMap("web_proxy")
+
+// webProxyMaxUpstreamMetrics caps the upstreams of a route, templated passes may resolve to any host,
+// so the upstreams beyond the cap are counted under "other".
+const webProxyMaxUpstreamMetrics = 256
+
+var webProxyLatencyBuckets = []struct {
+	Name string
+	Le   time.Duration
+}{
+	{"latency_le_5ms", 5 * time.Millisecond},
+	{"latency_le_10ms", 10 * time.Millisecond},
+	{"latency_le_25ms", 25 * time.Millisecond},
+	{"latency_le_50ms", 50 * time.Millisecond},
+	{"latency_le_100ms", 100 * time.Millisecond},
+	{"latency_le_250ms", 250 * time.Millisecond},
+	{"latency_le_500ms", 500 * time.Millisecond},
+	{"latency_le_1s", time.Second},
+	{"latency_le_2.5s", 2500 * time.Millisecond},
+	{"latency_le_5s", 5 * time.Second},
+	{"latency_le_10s", 10 * time.Second},
+}
+
+// HTTPWebProxyMetrics holds the request metrics of a proxy handler per upstream host, it is an expvar.Var
+// which embedders mount wherever they like, e.g. expvar.Publish, the zero value is ready to use.
+//
+// Each upstream has the counters requests, inflight, errors, status_1xx..status_5xx, conn_reused, conn_new,
+// circuit_breaker_rejects, circuit_breaker_trips and a latency histogram in the layout of prometheus, i.e.
+// the cumulative latency_le_* buckets with latency_count and latency_seconds_sum. A prometheus client is
+// not a dependency of liner, an exporter converts these vars instead.
+type HTTPWebProxyMetrics struct {
+	expvar.Map
+
+	mu    sync.Mutex
+	count int
+}
+
+// Upstream returns the metrics of upstream, or of "other" once the cap of upstreams is reached.
+func (m *HTTPWebProxyMetrics) Upstream(upstream string) *expvar.Map {
+	if v, ok := m.Get(upstream).(*expvar.Map); ok {
+		return v
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, ok := m.Get(upstream).(*expvar.Map); ok {
+		return v
+	}
+	if m.count >= webProxyMaxUpstreamMetrics {
+		upstream = "other"
+		if v, ok := m.Get(upstream).(*expvar.Map); ok {
+			return v
+		}
+	} else {
+		m.count++
+	}
+	v := new(expvar.Map).Init()
+	m.Set(upstream, v)
+	return v
+}
+
+// Observe records an upstream round trip, status codes are bucketed into classes to bound the cardinality.
+func (m *HTTPWebProxyMetrics) Observe(upstream *expvar.Map, elapsed time.Duration, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		upstream.Add("errors", 1)
+	case resp.StatusCode >= 100 && resp.StatusCode < 600:
+		upstream.Add("status_"+strconv.Itoa(resp.StatusCode/100)+"xx", 1)
+	default:
+		upstream.Add("status_other", 1)
+	}
+
+	for _, bucket := range webProxyLatencyBuckets {
+		if elapsed <= bucket.Le {
+			upstream.Add(bucket.Name, 1)
+		}
+	}
+	upstream.Add("latency_count", 1)
+	upstream.AddFloat("latency_seconds_sum", elapsed.Seconds())
+}
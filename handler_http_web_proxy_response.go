@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/valyala/bytebufferpool"
+)
+
+// copyResponse relays the upstream response resp of req to the client.
+func (h *HTTPWebProxyHandler) copyResponse(rw http.ResponseWriter, req *http.Request, resp *http.Response, ri *HTTPRequestInfo, st *webProxyState, proxypass *url.URL) {
+	if req.ProtoAtLeast(2, 0) || resp.StatusCode != http.StatusSwitchingProtocols {
+		for _, value := range resp.Header.Values("connection") {
+			for key := range strings.SplitSeq(value, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					resp.Header.Del(key)
+				}
+			}
+		}
+		resp.Header.Del("connection")
+		resp.Header.Del("keep-alive")
+	}
+
+	// the transport never reuses an upstream connection which answered with "connection: close",
+	// so the client connection is kept alive unless we are asked to follow the upstream.
+	if resp.Close && h.PropagateConnectionClose && req.ProtoMajor == 1 {
+		rw.Header().Set("connection", "close")
+	}
+
+	for _, key := range h.RemoveResponseHeaders {
+		resp.Header.Del(key)
+	}
+
+	if h.RequestIDHeader != "" {
+		// already set on rw, avoid a duplicate when upstream echoes it
+		resp.Header.Del(h.RequestIDHeader)
+	}
+
+	if h.Via != "" {
+		resp.Header.Add("via", viaProtocol(resp.ProtoMajor, resp.ProtoMinor)+" "+h.Via)
+	}
+
+	if h.DumpFailure && resp.StatusCode >= http.StatusBadRequest && h.sampleDump(ri) {
+		if h.DumpFailureRequest {
+			// the request body was consumed by upstream round trip, dump the headers only.
+			header := req.Header
+			req.Header = h.redact(header)
+			data, err := httputil.DumpRequestOut(req, false)
+			req.Header = header
+			if err != nil {
+				log.Warn().Err(err).Context(ri.LogContext).Str("req_url", req.URL.String()).Msg("DumpFailureRequest error")
+			} else {
+				log.Info().Context(ri.LogContext).Str("req_url", req.URL.String()).Str("data", h.truncate(data)).Msg("DumpFailureRequest ok")
+			}
+		}
+		header := resp.Header
+		resp.Header = h.redact(header)
+		data, err := httputil.DumpResponse(resp, true)
+		resp.Header = header
+		if err != nil {
+			log.Warn().Err(err).Context(ri.LogContext).Int("status", resp.StatusCode).Int64("content_length", resp.ContentLength).Msg("DumpFailureResponse error")
+		} else {
+			log.Info().Context(ri.LogContext).Int("status", resp.StatusCode).Int64("content_length", resp.ContentLength).Str("data", h.truncate(data)).Msg("DumpFailureResponse ok")
+		}
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		h.switchProtocols(rw, req, resp, ri, proxypass)
+		return
+	}
+
+	if location := resp.Header.Get("location"); location != "" {
+		client := &url.URL{Scheme: "http", Host: st.Host}
+		if ri.TLSVersion != 0 {
+			client.Scheme = "https"
+		}
+		// the scheme upstream sees itself served by
+		upstream := &url.URL{Scheme: proxypass.Scheme, Host: proxypass.Host}
+		switch proxypass.Scheme {
+		case "h2c":
+			upstream.Scheme = "http"
+		case "http3":
+			upstream.Scheme = "https"
+		}
+		resp.Header.Set("location", relativeLocation(location, client, upstream))
+	}
+	if len(h.CookieDomains) != 0 || len(h.CookiePaths) != 0 || h.CookieSecure || h.CookieSameSite != "" {
+		if cookies := resp.Header.Values("set-cookie"); len(cookies) != 0 {
+			for i, cookie := range cookies {
+				cookies[i] = h.rewriteCookie(cookie)
+			}
+		}
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	if h.SetResponseHeaders != "" {
+		h.setResponseHeaders(rw, req, resp, ri)
+	}
+	if h.SecurityHeaders && ri.TLSVersion != 0 {
+		// presets never override the headers from upstream or set_response_headers
+		for key, value := range map[string]string{
+			"strict-transport-security": "max-age=" + strconv.Itoa(cmp.Or(h.HSTSMaxAge, 31536000)),
+			"x-content-type-options":    "nosniff",
+			"x-frame-options":           "SAMEORIGIN",
+			"referrer-policy":           "strict-origin-when-cross-origin",
+		} {
+			if rw.Header().Get(key) == "" {
+				rw.Header().Set(key, value)
+			}
+		}
+	}
+	// the transport canonicalizes upstream header names, spell the configured ones as given for picky
+	// http/1.x clients, http/2 and http/3 always send lowercase names.
+	if req.ProtoMajor == 1 {
+		for _, name := range h.ResponseHeaderCase {
+			if key := http.CanonicalHeaderKey(name); key != name {
+				if values, ok := rw.Header()[key]; ok {
+					delete(rw.Header(), key)
+					rw.Header()[name] = values
+				}
+			}
+		}
+	}
+	// pass 304 through without a body, and answer 304 on behalf of upstreams which ignored the conditional request
+	if resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusOK && notModified(req, resp) {
+		rw.Header().Del("content-length")
+		rw.WriteHeader(http.StatusNotModified)
+		resp.Body.Close()
+		return
+	}
+	// a declared length over the limit is rejected before the header is sent, only bodies of an
+	// unknown length are truncated while streaming.
+	if h.MaxResponseBodySize > 0 && resp.ContentLength > h.MaxResponseBodySize && req.Method != http.MethodHead {
+		log.Warn().Context(ri.LogContext).Int("http_status", resp.StatusCode).Int64("http_content_length", resp.ContentLength).Int64("max_response_body_size", h.MaxResponseBodySize).Msg("proxy_pass response body too large")
+		resp.Body.Close()
+		http.Error(rw, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	if h.BufferResponse && req.Method != http.MethodHead && resp.StatusCode != http.StatusNoContent && len(resp.Trailer) == 0 {
+		if err := h.bufferResponseBody(resp); err != nil {
+			log.Warn().Err(err).Context(ri.LogContext).Int("http_status", resp.StatusCode).Msg("proxy_pass buffer response body error")
+			http.Error(rw, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+	}
+	// frame the relayed body by what upstream actually sends, a content-length from set_response_headers
+	// would be stale, and an unknown length (e.g. delimited by upstream connection close or decompressed
+	// by transport) or trailers make the server chunk it for keep-alive http/1.1 clients.
+	if req.Method != http.MethodHead && resp.StatusCode != http.StatusNoContent {
+		if resp.ContentLength >= 0 && len(resp.Trailer) == 0 {
+			rw.Header().Set("content-length", strconv.FormatInt(resp.ContentLength, 10))
+		} else {
+			rw.Header().Del("content-length")
+		}
+	}
+	// announce upstream trailers (e.g. grpc-status), the values arrive after the body
+	for key := range resp.Trailer {
+		rw.Header().Add("trailer", key)
+	}
+	rw.WriteHeader(resp.StatusCode)
+	defer resp.Body.Close()
+	var w io.Writer = rw
+	var body io.Reader = resp.Body
+	var stalled atomic.Bool
+	if mediatype, _, _ := strings.Cut(resp.Header.Get("content-type"), ";"); strings.EqualFold(strings.TrimSpace(mediatype), "text/event-stream") || resp.Header.Get("x-accel-buffering") == "no" {
+		// server-sent events and other unbuffered streams are flushed per write
+		rc := http.NewResponseController(rw)
+		rc.Flush()
+		w = HTTPFlushWriter{rw, rc}
+	} else {
+		if h.MaxResponseBodySize > 0 {
+			body = io.LimitReader(body, h.MaxResponseBodySize)
+		}
+		if h.ResponseIdleTimeout > 0 {
+			// closing the body unblocks the copy from an upstream which stalls mid-body
+			timer := time.AfterFunc(h.ResponseIdleTimeout, func() {
+				stalled.Store(true)
+				resp.Body.Close()
+			})
+			defer timer.Stop()
+			body = &idleTimerReader{body, timer, h.ResponseIdleTimeout}
+		}
+	}
+	rb := &webProxyBodyReader{Reader: body}
+	n, err := io.Copy(w, rb)
+	if err == nil && h.MaxResponseBodySize > 0 && n == h.MaxResponseBodySize {
+		if m, _ := resp.Body.Read(make([]byte, 1)); m > 0 {
+			log.Warn().Context(ri.LogContext).Int("http_status", resp.StatusCode).Int64("resp_body_bytes", n).Int64("max_response_body_size", h.MaxResponseBodySize).Msg("proxy_pass response body too large, truncated")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err != nil {
+		msg := "proxy_pass copy response body error"
+		if resp.ContentLength > 0 && n < resp.ContentLength {
+			// the upstream closed before sending the declared content-length
+			msg = "proxy_pass upstream truncated"
+		}
+		if stalled.Load() {
+			msg = "proxy_pass upstream stalled"
+		}
+		log.Warn().Err(err).Context(ri.LogContext).Int("http_status", resp.StatusCode).Int64("resp_body_bytes", n).Int64("http_content_length", resp.ContentLength).Strs("resp_transfer_encoding", resp.TransferEncoding).Msg(msg)
+		// the body is complete when only the trailer after the terminating chunk is malformed, finish
+		// the response cleanly if allowed, any other error aborts the client stream to signal truncation.
+		if h.IgnoreTrailerError && slices.Contains(resp.TransferEncoding, "chunked") && !stalled.Load() && isTrailerError(rb.err) {
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	// resp.Trailer is filled once the body reaches EOF, including trailers which were not announced
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			rw.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+}
+
+// webProxyBodyReader keeps the read error of a response body, to tell it apart from the write
+// errors of the client in io.Copy.
+type webProxyBodyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *webProxyBodyReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return
+}
+
+// isTrailerError reports whether err comes from parsing the trailer of a chunked body, which net/http
+// reads after the terminating zero-length chunk, a malformed line is a textproto.ProtocolError.
+func isTrailerError(err error) bool {
+	var perr textproto.ProtocolError
+	if err == nil || errors.As(err, &perr) {
+		return err != nil
+	}
+	switch err.Error() {
+	case "http: unexpected EOF reading trailer", "http: suspiciously long trailer after chunked body":
+		return true
+	}
+	return false
+}
+
+// relativeLocation turns an absolute location which points back at any of origins into a root-relative one,
+// so that the redirect follows the host used by client. the scheme must match, a redirect to another scheme
+// (e.g. http to https) is kept absolute, or it would loop.
+func relativeLocation(location string, origins ...*url.URL) string {
+	u, err := url.Parse(location)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return location
+	}
+
+	// compare hosts case-insensitively, with default ports omitted
+	normalize := func(host, scheme string) string {
+		if h, port, err := net.SplitHostPort(host); err == nil && (scheme == "http" && port == "80" || scheme == "https" && port == "443" || scheme == "") {
+			host = h
+		}
+		return strings.ToLower(strings.Trim(host, "[]"))
+	}
+
+	target, matched := normalize(u.Host, u.Scheme), false
+	for _, origin := range origins {
+		if host := origin.Host; host != "" && strings.EqualFold(origin.Scheme, u.Scheme) && (strings.EqualFold(host, u.Host) || normalize(host, "") == target) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return location
+	}
+
+	b := AppendableBytes(make([]byte, 0, len(location)))
+	if path := u.EscapedPath(); path != "" {
+		b = b.Str(path)
+	} else {
+		b = b.Str("/")
+	}
+	if u.ForceQuery || u.RawQuery != "" {
+		b = b.Str("?").Str(u.RawQuery)
+	}
+	if u.Fragment != "" {
+		b = b.Str("#").Str(u.EscapedFragment())
+	}
+	return string(b)
+}
+
+// rewriteCookie rewrites the domain and path attributes of a set-cookie value per CookieDomains and CookiePaths,
+// an empty domain mapping drops the attribute so that the cookie becomes host-only.
+func (h *HTTPWebProxyHandler) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	attrs := make([]string, 0, len(parts)+2)
+	attrs = append(attrs, parts[0])
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case strings.EqualFold(key, "domain"):
+			for from, to := range h.CookieDomains {
+				if strings.EqualFold(strings.TrimPrefix(from, "."), strings.TrimPrefix(value, ".")) {
+					part = " Domain=" + to
+					break
+				}
+			}
+			if part == " Domain=" {
+				continue
+			}
+		case strings.EqualFold(key, "path"):
+			// the longest matched prefix wins
+			var from string
+			for prefix := range h.CookiePaths {
+				if rest, ok := strings.CutPrefix(value, prefix); ok && (rest == "" || rest[0] == '/' || strings.HasSuffix(prefix, "/")) && len(prefix) > len(from) {
+					from = prefix
+				}
+			}
+			if from != "" {
+				// keep the slash of a prefix such as /api/, so /api/users maps to /users rather than users
+				part = " Path=" + cmp.Or(strings.TrimSuffix(h.CookiePaths[from], "/")+value[len(strings.TrimSuffix(from, "/")):], "/")
+			}
+		case strings.EqualFold(key, "secure") && h.CookieSecure:
+			continue
+		case strings.EqualFold(key, "samesite") && h.CookieSameSite != "":
+			continue
+		}
+		attrs = append(attrs, part)
+	}
+	if h.CookieSecure {
+		attrs = append(attrs, " Secure")
+	}
+	if h.CookieSameSite != "" {
+		attrs = append(attrs, " SameSite="+h.CookieSameSite)
+	}
+	return strings.Join(attrs, ";")
+}
+
+// notModified evaluates the conditional GET/HEAD request against response validators, see https://www.rfc-editor.org/rfc/rfc9110#section-13.2.2
+func notModified(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Get("if-none-match"); inm != "" {
+		etag := strings.TrimPrefix(resp.Header.Get("etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for tag := range strings.SplitSeq(inm, ",") {
+			// weak comparison
+			if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("if-modified-since"); ims != "" {
+		since, err1 := http.ParseTime(ims)
+		modified, err2 := http.ParseTime(resp.Header.Get("last-modified"))
+		return err1 == nil && err2 == nil && !modified.After(since)
+	}
+
+	return false
+}
+
+type idleTimerReader struct {
+	io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimerReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return
+}
+
+// bufferResponseBody reads the response body up to BufferResponseMaxBytes and releases the upstream
+// connection before the body is written to a possibly slow client, larger bodies are streamed.
+func (h *HTTPWebProxyHandler) bufferResponseBody(resp *http.Response) error {
+	limit := cmp.Or(h.BufferResponseMaxBytes, 1<<20)
+	if resp.ContentLength > limit {
+		return nil
+	}
+	if mediatype, _, _ := strings.Cut(resp.Header.Get("content-type"), ";"); strings.EqualFold(strings.TrimSpace(mediatype), "text/event-stream") || resp.Header.Get("x-accel-buffering") == "no" {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return nil
+	}
+
+	resp.Body.Close()
+	resp.ContentLength, resp.TransferEncoding = int64(len(data)), nil
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+func (h *HTTPWebProxyHandler) setResponseHeaders(rw http.ResponseWriter, req *http.Request, resp *http.Response, ri *HTTPRequestInfo) {
+	if h.respheaders == nil {
+		applyHeaders(s2b(h.SetResponseHeaders), rw.Header())
+		return
+	}
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+	bb.Reset()
+	h.execute(h.respheaders, bb, req, resp, ri)
+	applyHeaders(bb.B, rw.Header())
+}
+
+// sampleDump reports whether a failure could be dumped within DumpFailureRate per minute,
+// the number of dumps suppressed since last dump is logged.
+func (h *HTTPWebProxyHandler) sampleDump(ri *HTTPRequestInfo) bool {
+	if h.DumpFailureRate <= 0 {
+		return true
+	}
+
+	minute := time.Now().Unix() / 60
+	if m := h.dumpminute.Load(); m != minute && h.dumpminute.CompareAndSwap(m, minute) {
+		h.dumpcount.Store(0)
+	}
+
+	if h.dumpcount.Add(1) > int64(h.DumpFailureRate) {
+		h.dumpsuppressed.Add(1)
+		return false
+	}
+
+	if n := h.dumpsuppressed.Swap(0); n > 0 {
+		log.Info().Context(ri.LogContext).Int64("suppressed", n).Int("dump_failure_rate", h.DumpFailureRate).Msg("DumpFailure suppressed by sampling")
+	}
+	return true
+}
+
+var defaultWebProxyDumpRedactHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie"}
+
+// redact returns a copy of header with the values of sensitive headers masked, for dumping.
+func (h *HTTPWebProxyHandler) redact(header http.Header) http.Header {
+	keys := h.DumpRedactHeaders
+	if len(keys) == 0 {
+		keys = defaultWebProxyDumpRedactHeaders
+	}
+	header = header.Clone()
+	for _, key := range keys {
+		if _, ok := header[http.CanonicalHeaderKey(key)]; ok {
+			header.Set(key, "***")
+		}
+	}
+	return header
+}
+
+func (h *HTTPWebProxyHandler) truncate(data []byte) string {
+	// a negative DumpMaxBytes disables the cap
+	if limit := cmp.Or(h.DumpMaxBytes, 4096); limit > 0 && len(data) > limit {
+		return string(data[:limit]) + "...(truncated " + strconv.Itoa(len(data)-limit) + " bytes)"
+	}
+	return string(data)
+}
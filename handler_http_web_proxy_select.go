@@ -0,0 +1,513 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+	"github.com/valyala/bytebufferpool"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// route resolves the pass of req before the target selection, ok is false once rw has been answered.
+func (h *HTTPWebProxyHandler) route(rw http.ResponseWriter, req *http.Request, ri *HTTPRequestInfo) (proxypass *url.URL, fallback bool, ok bool) {
+	var route *url.URL
+	if name := h.UpstreamHeader; name != "" {
+		// ops may force the upstream from trusted ips, the header never reaches upstream. the tcp peer is
+		// checked as the real ip may come from a forged x-forwarded-for.
+		if value := req.Header.Get(name); value != "" && slices.ContainsFunc(h.upcidrs, func(prefix netip.Prefix) bool { return prefix.Contains(ri.RemoteAddr.Addr().Unmap()) }) {
+			u, err := url.Parse(strings.TrimSpace(value))
+			if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "h2c", "http3"}, u.Scheme) {
+				http.Error(rw, fmt.Sprintf("400 bad %s: %q", name, value), http.StatusBadRequest)
+				return nil, false, false
+			}
+			log.Info().Context(ri.LogContext).Str("upstream_header", value).Msg("proxy_pass upstream forced by header")
+			route = u
+		}
+		req.Header.Del(name)
+	}
+	if route == nil && h.ctroutes != nil && req.Header.Get("content-type") != "" {
+		route = h.contentTypeRoute(req.Header.Get("content-type"))
+	}
+
+	switch {
+	case route != nil:
+		proxypass = route
+	case h.userchecker != nil && ri.AuthUserInfo.Attrs["upstream"] != "":
+		// per user upstream from auth_table attributes overrides the proxypass
+		var err error
+		proxypass, err = url.Parse(strings.TrimSpace(ri.AuthUserInfo.Attrs["upstream"]))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("bad proxypass %+v", proxypass), http.StatusServiceUnavailable)
+			return nil, false, false
+		}
+	case h.Resolver != nil || h.proxypass.Template != nil:
+		var pass string
+		var err error
+		if h.Resolver != nil {
+			pass, err = h.Resolver(req, ri)
+		} else {
+			ri.PolicyBuffer.Reset()
+			err = h.execute(h.proxypass.Template, &ri.PolicyBuffer, req, nil, ri)
+			pass = b2s(ri.PolicyBuffer.B)
+		}
+		if h.DefaultPass != "" && (err != nil || strings.TrimSpace(pass) == "") {
+			log.Warn().Context(ri.LogContext).Err(err).Str("req_host", req.Host).Str("req_url", req.URL.String()).Str("default_pass", h.DefaultPass).Msg("proxy_pass unresolved, fall back to default_pass")
+			pass, err, fallback = h.DefaultPass, nil, true
+		}
+		if err != nil && h.Resolver != nil {
+			log.Error().Context(ri.LogContext).Err(err).Msg("proxy_pass resolver error")
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+			return nil, false, false
+		}
+		if err != nil {
+			// a partially rendered pass must not be dialed
+			log.Error().Context(ri.LogContext).Err(err).Str("req_host", req.Host).Str("req_url", req.URL.String()).Msg("proxy_pass template error")
+			http.Error(rw, "502 Bad Gateway: proxy_pass template error", http.StatusBadGateway)
+			return nil, false, false
+		}
+		if status, ok := parseProxyPassStatus(pass); ok {
+			status.ServeHTTP(rw, req)
+			return nil, false, false
+		}
+		if strings.TrimSpace(pass) == "" {
+			// e.g. a template conditional without an else branch
+			log.Error().Context(ri.LogContext).Str("req_host", req.Host).Str("req_url", req.URL.String()).Msg("proxy_pass resolved to an empty upstream")
+			http.Error(rw, "502 Bad Gateway: proxy_pass resolved to an empty upstream", http.StatusBadGateway)
+			return nil, false, false
+		}
+		proxypass, err = url.Parse(strings.TrimSpace(pass))
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("bad proxypass %+v", proxypass), http.StatusServiceUnavailable)
+			return nil, false, false
+		}
+	case h.proxypass.Status != nil:
+		h.proxypass.Status.ServeHTTP(rw, req)
+		return nil, false, false
+	default:
+		proxypass = h.proxypass.URL
+	}
+
+	return proxypass, fallback, true
+}
+
+// selectTarget picks the target of proxypass among its srv records or the upstreams, breaker is the circuit
+// breaker of the target if the selection took its probe. ok is false once rw has been answered.
+func (h *HTTPWebProxyHandler) selectTarget(rw http.ResponseWriter, req *http.Request, ri *HTTPRequestInfo, proxypass *url.URL) (*url.URL, *webProxyBreaker, bool) {
+	// srv+http://web.service.consul picks a target of the dns srv records per request,
+	// and upstreams replace the host of the configured pass likewise, other resolved upstreams are used as is.
+	var addrs []*net.SRV
+	if scheme, ok := strings.CutPrefix(proxypass.Scheme, "srv+"); ok {
+		var err error
+		addrs, err = h.lookupSRV(req.Context(), proxypass.Hostname())
+		if err != nil {
+			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Msg("proxy_pass srv lookup error")
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return nil, nil, false
+		}
+		u := *proxypass
+		u.Scheme = scheme
+		proxypass = &u
+	} else if len(h.upstreams) != 0 && proxypass == h.proxypass.URL {
+		addrs = h.upstreams
+	}
+	if addrs == nil {
+		return proxypass, nil, true
+	}
+
+	var target string
+	var breaker *webProxyBreaker
+	if h.StickyCookie.Name != "" {
+		target, breaker = h.stickyTarget(rw, req, addrs)
+	} else {
+		var addr *net.SRV
+		addr, breaker = h.pickTarget(addrs)
+		target = srvTarget(addr)
+	}
+	u := *proxypass
+	u.Host = target
+
+	return &u, breaker, true
+}
+
+// contentTypeRoute returns the content_type_routes upstream of the media type, application/grpc
+// also matches structured suffixes such as application/grpc+proto.
+func (h *HTTPWebProxyHandler) contentTypeRoute(contentType string) *url.URL {
+	mediatype, _, _ := strings.Cut(contentType, ";")
+	mediatype = strings.ToLower(strings.TrimSpace(mediatype))
+	if u, ok := h.ctroutes[mediatype]; ok {
+		return u
+	}
+	if i := strings.IndexByte(mediatype, '+'); i > 0 {
+		return h.ctroutes[mediatype[:i]]
+	}
+	return nil
+}
+
+// webProxySRV caches the srv records of a service name.
+type webProxySRV struct {
+	mu      sync.Mutex
+	addrs   []*net.SRV
+	expires time.Time
+}
+
+// lookupSRV resolves name to the srv records and caches them by the record ttl, clamped
+// to [5s, SRVRefresh], stale records are kept on lookup errors.
+func (h *HTTPWebProxyHandler) lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	srv, _ := h.srvs.LoadOrCompute(name, func() (*webProxySRV, bool) {
+		return new(webProxySRV), false
+	})
+
+	srv.mu.Lock()
+	if now := time.Now(); now.After(srv.expires) {
+		addrs, ttl, err := h.querySRV(ctx, name)
+		switch {
+		case err == nil && len(addrs) != 0:
+			srv.addrs = addrs
+		case len(srv.addrs) != 0:
+			log.Warn().Err(err).Str("srv_name", name).Int("srv_stale_targets", len(srv.addrs)).Msg("proxy_pass srv lookup error, use stale records")
+		default:
+			srv.mu.Unlock()
+			if err == nil {
+				err = fmt.Errorf("no srv records of %s", name)
+			}
+			return nil, err
+		}
+		srv.expires = now.Add(min(max(ttl, 5*time.Second), cmp.Or(h.SRVRefresh, 30*time.Second)))
+	}
+	addrs := srv.addrs
+	srv.mu.Unlock()
+
+	return addrs, nil
+}
+
+// querySRV looks up the srv records of name via the dns_server resolver and returns the
+// lowest record ttl, it falls back to the system resolver cached for SRVRefresh.
+func (h *HTTPWebProxyHandler) querySRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	if h.DnsResolver == nil || h.DnsResolver.Client == nil || godebugnetdns {
+		_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		return addrs, cmp.Or(h.SRVRefresh, 30*time.Second), err
+	}
+
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(fastrandn(math.MaxUint16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if b, err = h.DnsResolver.Exchange(ctx, b); err != nil {
+		return nil, 0, err
+	}
+	if err = msg.Unpack(b); err != nil {
+		return nil, 0, err
+	}
+	if msg.Header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("srv lookup %s: %s", name, msg.Header.RCode)
+	}
+
+	var addrs []*net.SRV
+	var ttl uint32 = math.MaxUint32
+	for _, answer := range msg.Answers {
+		if r, ok := answer.Body.(*dnsmessage.SRVResource); ok {
+			addrs = append(addrs, &net.SRV{
+				Target:   r.Target.String(),
+				Port:     r.Port,
+				Priority: r.Priority,
+				Weight:   r.Weight,
+			})
+			ttl = min(ttl, answer.Header.TTL)
+		}
+	}
+	// keep the priority order of net.Resolver.LookupSRV for pickSRV
+	slices.SortStableFunc(addrs, func(a, b *net.SRV) int { return cmp.Compare(a.Priority, b.Priority) })
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+func srvTarget(addr *net.SRV) string {
+	return net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+}
+
+// pickSRV selects a record of the lowest priority, weighted randomly as RFC 2782.
+func pickSRV(addrs []*net.SRV) *net.SRV {
+	// net.Resolver.LookupSRV sorts the records by priority
+	n, total := 0, 0
+	for n < len(addrs) && addrs[n].Priority == addrs[0].Priority {
+		total += int(addrs[n].Weight)
+		n++
+	}
+	if total == 0 {
+		return addrs[fastrandn(uint32(n))]
+	}
+	w := int(fastrandn(uint32(total)))
+	for _, addr := range addrs[:n] {
+		if w -= int(addr.Weight); w < 0 {
+			return addr
+		}
+	}
+	return addrs[0]
+}
+
+// webProxyBreaker is a circuit breaker of an upstream, it opens after consecutive failures
+// within a window, and lets a single probe through once the cooldown elapsed.
+type webProxyBreaker struct {
+	mu       sync.Mutex
+	failures int
+	since    time.Time
+	opened   time.Time
+	probing  bool
+}
+
+func (b *webProxyBreaker) Allow(now time.Time, cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.opened.IsZero() {
+		return true
+	}
+	if b.probing || now.Sub(b.opened) < cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Opened reports whether the breaker is open, without taking the probe.
+func (b *webProxyBreaker) Opened() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.opened.IsZero()
+}
+
+// Release gives back the probe taken by Allow without recording a result.
+func (b *webProxyBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Record reports whether the breaker was tripped open by this failure.
+func (b *webProxyBreaker) Record(now time.Time, failed bool, threshold int, window time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probing := b.probing
+	b.probing = false
+
+	if !failed {
+		b.failures, b.opened = 0, time.Time{}
+		return false
+	}
+
+	if b.failures == 0 || now.Sub(b.since) > window {
+		b.failures, b.since = 0, now
+	}
+	b.failures++
+
+	if probing || (b.opened.IsZero() && b.failures >= threshold) {
+		b.opened = now
+		return true
+	}
+	return false
+}
+
+// allowTarget returns the circuit breaker of target and whether target takes the request, a
+// half-open breaker lets a single probe through once the cooldown elapsed.
+func (h *HTTPWebProxyHandler) allowTarget(target string) (*webProxyBreaker, bool) {
+	if h.breakers == nil {
+		return nil, true
+	}
+	breaker, _ := h.breakers.LoadOrCompute(target, func() (*webProxyBreaker, bool) {
+		return new(webProxyBreaker), false
+	})
+	return breaker, breaker.Allow(time.Now(), cmp.Or(h.CircuitBreakerCooldown, 30*time.Second))
+}
+
+// pickTarget selects an allowed record of the lowest priority, so the traffic fails over to the next
+// priority once all targets of a priority tripped the circuit breaker, and fails back after a probe
+// of a half-open target succeeds. The breaker is nil when every target is rejected.
+func (h *HTTPWebProxyHandler) pickTarget(addrs []*net.SRV) (*net.SRV, *webProxyBreaker) {
+	candidates := slices.Clone(addrs)
+	for len(candidates) != 0 {
+		addr := pickSRV(candidates)
+		if breaker, ok := h.allowTarget(srvTarget(addr)); ok {
+			return addr, breaker
+		}
+		candidates = slices.DeleteFunc(candidates, func(c *net.SRV) bool { return c == addr })
+	}
+	return pickSRV(addrs), nil
+}
+
+// HTTPWebProxyStickyCookie pins a client to an upstream of the srv targets or upstreams.
+type HTTPWebProxyStickyCookie struct {
+	Name   string        // cookie name, e.g. lb
+	TTL    time.Duration // cookie max age, a session cookie by default
+	Secret string        // hmac key of the cookie value
+}
+
+// stickyTarget returns the upstream pinned by the sticky cookie, or pins an allowed one when the
+// cookie is absent, forged, or its upstream is gone or rejected by the circuit breaker.
+func (h *HTTPWebProxyHandler) stickyTarget(rw http.ResponseWriter, req *http.Request, addrs []*net.SRV) (string, *webProxyBreaker) {
+	if cookie, err := req.Cookie(h.StickyCookie.Name); err == nil {
+		for _, addr := range addrs {
+			target := srvTarget(addr)
+			if !hmac.Equal([]byte(cookie.Value), []byte(h.stickyValue(target))) {
+				continue
+			}
+			if breaker, ok := h.allowTarget(target); ok {
+				return target, breaker
+			}
+			break
+		}
+	}
+
+	addr, breaker := h.pickTarget(addrs)
+	target := srvTarget(addr)
+
+	http.SetCookie(rw, &http.Cookie{
+		Name:     h.StickyCookie.Name,
+		Value:    h.stickyValue(target),
+		Path:     "/",
+		MaxAge:   int(h.StickyCookie.TTL / time.Second),
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return target, breaker
+}
+
+// stickyValue signs target as an opaque cookie value, so upstream addresses are not exposed.
+func (h *HTTPWebProxyHandler) stickyValue(target string) string {
+	mac := hmac.New(sha256.New, []byte(h.StickyCookie.Secret))
+	mac.Write([]byte(target))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// proxyPassStatus is a proxypass answered by liner itself instead of an upstream.
+type proxyPassStatus struct {
+	Code        int
+	Location    string
+	ContentType string
+	Body        string
+}
+
+// parseProxyPassStatus parses a proxypass of below forms
+//
+//	<code>
+//	<3xx code> <location>
+//	<code> <content-type>\n<body>
+//
+// the body form is told apart by the first line break, which never appears in an url.
+func parseProxyPassStatus(s string) (status proxyPassStatus, ok bool) {
+	line, body, _ := strings.Cut(strings.TrimLeft(s, " \t\r\n"), "\n")
+	code, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 100 || n > 999 {
+		return status, false
+	}
+	status.Code = n
+	arg = strings.TrimSpace(arg)
+
+	if strings.TrimSpace(body) != "" {
+		status.ContentType = cmp.Or(arg, "text/plain; charset=utf-8")
+		status.Body = body
+		return status, true
+	}
+
+	if arg != "" {
+		if n < 300 || n > 399 {
+			return status, false
+		}
+		status.Location = arg
+	}
+	return status, true
+}
+
+func (status proxyPassStatus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case status.ContentType != "":
+		rw.Header().Set("content-type", status.ContentType)
+		rw.Header().Set("content-length", strconv.Itoa(len(status.Body)))
+		rw.WriteHeader(status.Code)
+		if req.Method != http.MethodHead {
+			io.WriteString(rw, status.Body)
+		}
+	case status.Location != "":
+		http.Redirect(rw, req, status.Location, status.Code)
+	default:
+		http.Error(rw, fmt.Sprintf("%d %s", status.Code, http.StatusText(status.Code)), status.Code)
+	}
+}
+
+// Resolve renders the proxypass and set_headers templates for req without proxying, it returns the
+// resolved proxypass and the headers which would be set on the upstream request, for validating configs.
+func (h *HTTPWebProxyHandler) Resolve(req *http.Request, ri *HTTPRequestInfo) (string, http.Header, error) {
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	var pass string
+	switch {
+	case h.Resolver != nil || h.proxypass.Template != nil:
+		if h.Resolver != nil {
+			s, err := h.Resolver(req, ri)
+			if err != nil {
+				return "", nil, err
+			}
+			pass = strings.TrimSpace(s)
+		} else {
+			bb.Reset()
+			if err := h.execute(h.proxypass.Template, bb, req, nil, ri); err != nil {
+				return "", nil, err
+			}
+			pass = strings.TrimSpace(bb.String())
+		}
+		if pass == "" {
+			return "", nil, errors.New("proxy_pass resolved to an empty upstream")
+		}
+		if _, ok := parseProxyPassStatus(pass); !ok {
+			if _, err := url.Parse(pass); err != nil {
+				return pass, nil, err
+			}
+		}
+	case h.proxypass.Status != nil:
+		pass = strings.TrimSpace(h.Pass)
+	default:
+		pass = h.proxypass.URL.String()
+	}
+
+	header := make(http.Header)
+	if h.SetHeaders != "" {
+		if err := h.renderHeaders(bb, req, ri); err != nil {
+			return pass, nil, err
+		}
+		applyHeaders(bb.B, header)
+	}
+
+	return pass, header, nil
+}
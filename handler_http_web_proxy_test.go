@@ -0,0 +1,2340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/phuslu/fastdns"
+	"github.com/phuslu/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestWebProxyServer(t *testing.T, h *HTTPWebProxyHandler) *httptest.Server {
+	if h.Transport == nil {
+		h.Transport = &http.Transport{}
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ri := new(HTTPRequestInfo)
+		ri.RemoteAddr, _ = netip.ParseAddrPort(req.RemoteAddr)
+		ri.RealIP = ri.RemoteAddr.Addr()
+		h.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestRawUpstream answers every request with the raw http response and closes the connection.
+func newTestRawUpstream(t *testing.T, response string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %+v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				io.WriteString(conn, response)
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String()
+}
+
+func TestWebProxyUpstreamConnectionClose(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("connection", "close")
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		Propagate bool
+		Close     bool
+	}{
+		{false, false},
+		{true, true},
+	}
+
+	for _, c := range cases {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:                     upstream.URL,
+			PropagateConnectionClose: c.Propagate,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "ok" {
+			t.Errorf("propagate=%v body must be %#v, not %#v", c.Propagate, "ok", string(body))
+		}
+		if resp.Close != c.Close {
+			t.Errorf("propagate=%v resp.Close must be %v, not %v", c.Propagate, c.Close, resp.Close)
+		}
+	}
+}
+
+func TestWebProxyUpstreamHTTP10(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %+v", err)
+	}
+	defer ln.Close()
+
+	// a legacy upstream which ignores keep-alive and delimits the body by closing the connection
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				io.WriteString(conn, "HTTP/1.0 200 OK\r\ncontent-type: text/plain\r\nx-connection: "+req.Header.Get("connection")+"\r\n\r\nhello")
+			}()
+		}
+	}()
+
+	for _, force := range []bool{false, true} {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:                 "http://" + ln.Addr().String(),
+			ForceConnectionClose: force,
+		})
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		for i := range 2 {
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatalf("force=%v #%d http.Get(%#v) error: %+v", force, i, server.URL, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(body) != "hello" {
+				t.Errorf("force=%v #%d body must be %#v, not %#v", force, i, "hello", string(body))
+			}
+			if resp.ContentLength != -1 || !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+				t.Errorf("force=%v #%d response must be chunked, not content_length=%d transfer_encoding=%v", force, i, resp.ContentLength, resp.TransferEncoding)
+			}
+			if resp.Close {
+				t.Errorf("force=%v #%d client connection must be kept alive", force, i)
+			}
+			if got := resp.Header.Get("x-connection"); force != (got == "close") {
+				t.Errorf("force=%v #%d upstream request connection header must not be %#v", force, i, got)
+			}
+		}
+	}
+}
+
+func TestWebProxyEarlyHints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("link", "</style.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.Header().Del("link")
+		rw.Header().Set("content-type", "text/html")
+		io.WriteString(rw, "ok")
+	}))
+	defer upstream.Close()
+
+	for _, enabled := range []bool{true, false} {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:            upstream.URL,
+			RequestIDHeader: "x-request-id",
+			EarlyHints:      enabled,
+		})
+
+		var hints []http.Header
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, http.Header(header))
+				}
+				return nil
+			},
+		})
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if !enabled {
+			if len(hints) != 0 {
+				t.Errorf("103 early hints must not be relayed unless early_hints is set, got %v", hints)
+			}
+		} else if len(hints) != 1 || hints[0].Get("link") != "</style.css>; rel=preload; as=style" {
+			t.Fatalf("103 early hints must be relayed with the link header, not %v", hints)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("link") != "" || resp.Header.Get("x-request-id") == "" {
+			t.Errorf("final response must keep its own headers only, not %d %v", resp.StatusCode, resp.Header)
+		}
+	}
+}
+
+func TestWebProxyPassPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.RequestURI)
+	}))
+	defer upstream.Close()
+
+	cases := []struct {
+		Pass       string
+		RequestURI string
+		Result     string
+	}{
+		{"", "/foo?a=1", "/foo?a=1"},
+		{"/", "/foo?a=1", "/foo?a=1"},
+		{"/bar", "/foo?a=1", "/foo?a=1"},
+		{"/bar?b=2", "/foo?a=1", "/foo?a=1"},
+		{"/v2/*", "/foo?a=1", "/v2/foo?a=1"},
+		{"/v2/*?b=2", "/foo?a=1", "/v2/foo?b=2&a=1"},
+		{"/v2/*", "/a%2Fb", "/v2/a%2Fb"},
+	}
+
+	for _, c := range cases {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass: upstream.URL + c.Pass,
+		})
+
+		resp, err := http.Get(server.URL + c.RequestURI)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL+c.RequestURI, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != c.Result {
+			t.Errorf("pass=%#v request=%#v upstream request uri must be %#v, not %#v", c.Pass, c.RequestURI, c.Result, string(body))
+		}
+	}
+}
+
+func TestWebProxyResolve(t *testing.T) {
+	h := &HTTPWebProxyHandler{
+		Transport:  &http.Transport{},
+		Pass:       `http://{{ .Request.Host }}:8080`,
+		SetHeaders: "x-user: {{ .Username }}\n+x-tag: a\nhost: upstream.local\n",
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+	ri := &HTTPRequestInfo{AuthUserInfo: AuthUserInfo{Username: "alice"}}
+
+	pass, header, err := h.Resolve(req, ri)
+	if err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Resolve() error: %+v", err)
+	}
+	if want := "http://example.com:8080"; pass != want {
+		t.Errorf("resolved proxypass must be %#v, not %#v", want, pass)
+	}
+	for key, want := range map[string]string{"x-user": "alice", "x-tag": "a", "host": "upstream.local"} {
+		if got := header.Get(key); got != want {
+			t.Errorf("resolved header %#v must be %#v, not %#v", key, want, got)
+		}
+	}
+	if req.Header.Get("x-user") != "" {
+		t.Errorf("Resolve must not modify the request headers")
+	}
+}
+
+func TestWebProxyPassEmpty(t *testing.T) {
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass: `{{ if eq .Request.Method "POST" }}http://127.0.0.1:1{{ end }}`,
+	})
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway || !bytes.Contains(body, []byte("empty upstream")) {
+		t.Errorf("empty proxypass must answer 502 empty upstream, not %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestWebProxyDefaultPass(t *testing.T) {
+	fallback := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "fallback")
+	}))
+	defer fallback.Close()
+
+	for _, pass := range []string{
+		`{{ if eq .Request.Method "POST" }}http://127.0.0.1:1{{ end }}`,
+		`http://127.0.0.1:1`,
+	} {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:        pass,
+			DefaultPass: fallback.URL,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "fallback" {
+			t.Errorf("proxypass %#v must fall back to default_pass, not %d %q", pass, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestWebSocketKey(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 100 {
+		key := newWebSocketKey()
+		if len(key) != 24 {
+			t.Fatalf("websocket key %#v must be 24 bytes in base64", key)
+		}
+		nonce, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			t.Fatalf("websocket key %#v is not base64: %+v", key, err)
+		}
+		if len(nonce) != 16 {
+			t.Fatalf("websocket key %#v must be a 16-byte nonce, not %d bytes", key, len(nonce))
+		}
+		if seen[key] {
+			t.Fatalf("websocket key %#v is repeated", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestForwardedElement(t *testing.T) {
+	cases := []struct {
+		Forwarded  string
+		RemoteAddr string
+		ServerAddr string
+		Host       string
+		TLS        bool
+		Result     string
+	}{
+		{"", "192.0.2.60:1234", "", "example.com", false, `for=192.0.2.60;host=example.com;proto=http`},
+		{"", "[2001:db8::1]:1234", "10.0.0.1:443", "example.com", true, `for="[2001:db8::1]";by="10.0.0.1:443";host=example.com;proto=https`},
+		{"for=198.51.100.17", "192.0.2.60:1234", "", "example.com:8080", false, `for=198.51.100.17, for=192.0.2.60;host="example.com:8080";proto=http`},
+	}
+
+	for _, c := range cases {
+		ri := new(HTTPRequestInfo)
+		ri.RemoteAddr = netip.MustParseAddrPort(c.RemoteAddr)
+		if c.ServerAddr != "" {
+			ri.ServerAddr = netip.MustParseAddrPort(c.ServerAddr)
+		}
+		if c.TLS {
+			ri.TLSVersion = tls.VersionTLS13
+		}
+		if got := forwardedElement(c.Forwarded, ri, c.Host); got != c.Result {
+			t.Errorf("forwardedElement(%q, %s, %q) = %s, want %s", c.Forwarded, c.RemoteAddr, c.Host, got, c.Result)
+		}
+	}
+}
+
+func TestAppendWebSocketRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "https://example.com/ws", nil)
+	req.RequestURI = "/ws"
+	req.Header = http.Header{
+		":protocol":              {"websocket"},
+		"Connection":             {"Upgrade, X-Hop"},
+		"Upgrade":                {"websocket"},
+		"X-Hop":                  {"1"},
+		"Keep-Alive":             {"timeout=5"},
+		"Host":                   {"client.example.com"},
+		"Sec-Websocket-Key":      {"client"},
+		"Sec-Websocket-Version":  {"13"},
+		"Sec-Websocket-Protocol": {"chat"},
+	}
+
+	b, ok := appendWebSocketRequest(nil, req, "key", 64<<10)
+	if !ok {
+		t.Fatalf("appendWebSocketRequest() must be ok")
+	}
+	wsreq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatalf("http.ReadRequest(%q) error: %+v", b, err)
+	}
+
+	if wsreq.Method != http.MethodGet || wsreq.RequestURI != "/ws" || wsreq.Host != "example.com" {
+		t.Errorf("websocket request line must be GET /ws of example.com, not %s %s of %s", wsreq.Method, wsreq.RequestURI, wsreq.Host)
+	}
+	for key, want := range map[string][]string{
+		"Connection":             {"Upgrade"},
+		"Upgrade":                {"websocket"},
+		"Sec-Websocket-Key":      {"key"},
+		"Sec-Websocket-Version":  {"13"},
+		"Sec-Websocket-Protocol": {"chat"},
+		"X-Hop":                  nil,
+		"Keep-Alive":             nil,
+	} {
+		if got := wsreq.Header.Values(key); !slices.Equal(got, want) {
+			t.Errorf("websocket request header %s must be %q, not %q", key, want, got)
+		}
+	}
+
+	if _, ok := appendWebSocketRequest(nil, req, "key", 16); ok {
+		t.Errorf("appendWebSocketRequest() must fail over the header limit")
+	}
+}
+
+func TestWebProxyPickTarget(t *testing.T) {
+	h := &HTTPWebProxyHandler{
+		Pass:                    "http://backend",
+		Upstreams:               []string{"10.0.0.9:80 priority=1", "10.0.0.1:80 weight=2", "10.0.0.2:80"},
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCooldown:  100 * time.Millisecond,
+		Transport:               &http.Transport{},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	// pick records a success like a finished round trip, so a taken probe is given back
+	pick := func() string {
+		addr, breaker := h.pickTarget(h.upstreams)
+		if breaker != nil {
+			breaker.Record(time.Now(), false, 1, time.Minute)
+		}
+		return srvTarget(addr)
+	}
+	trip := func(target string) {
+		breaker, _ := h.breakers.LoadOrCompute(target, func() (*webProxyBreaker, bool) { return new(webProxyBreaker), false })
+		breaker.Record(time.Now(), true, 1, time.Minute)
+	}
+
+	for range 100 {
+		if target := pick(); target == "10.0.0.9:80" {
+			t.Fatalf("secondary %s must not be picked while primaries are healthy", target)
+		}
+	}
+
+	trip("10.0.0.1:80")
+	for range 100 {
+		if target := pick(); target != "10.0.0.2:80" {
+			t.Fatalf("healthy primary 10.0.0.2:80 must be picked, not %s", target)
+		}
+	}
+
+	trip("10.0.0.1:80")
+	trip("10.0.0.2:80")
+	for range 10 {
+		if target := pick(); target != "10.0.0.9:80" {
+			t.Fatalf("secondary 10.0.0.9:80 must be picked once primaries are down, not %s", target)
+		}
+	}
+
+	// a half-open primary takes a probe after the cooldown, its success fails the traffic back
+	time.Sleep(150 * time.Millisecond)
+	if target := pick(); target == "10.0.0.9:80" {
+		t.Fatalf("a primary must be probed after the cooldown, not %s", target)
+	}
+	if target := pick(); target == "10.0.0.9:80" {
+		t.Fatalf("traffic must fail back to the primaries, not %s", target)
+	}
+
+	// a failed probe keeps the primary out until the next cooldown
+	trip("10.0.0.1:80")
+	trip("10.0.0.2:80")
+	time.Sleep(150 * time.Millisecond)
+	addr, breaker := h.pickTarget(h.upstreams)
+	if breaker == nil || srvTarget(addr) == "10.0.0.9:80" {
+		t.Fatalf("a primary must be probed after the cooldown, not %s", srvTarget(addr))
+	}
+	breaker.Record(time.Now(), true, 1, time.Minute)
+	for range 10 {
+		if target := pick(); target == srvTarget(addr) {
+			t.Fatalf("primary %s failed its probe and must not be picked before the next cooldown", target)
+		}
+	}
+}
+
+func TestWebProxyFailoverRequiresBreaker(t *testing.T) {
+	h := &HTTPWebProxyHandler{
+		Pass:      "http://backend",
+		Upstreams: []string{"10.0.0.1:80", "10.0.0.9:80 priority=1"},
+		Transport: &http.Transport{},
+	}
+	if err := h.Load(); err == nil {
+		t.Fatalf("upstreams of several priorities without circuit_breaker_threshold must be rejected")
+	}
+}
+
+func TestAuthUserSignature(t *testing.T) {
+	// echo -n 'alice.1700000000' | openssl dgst -sha256 -hmac secret
+	want := "t=1700000000,v1=5618e4566baef6c21470cd379b4c24a07a67e6296560dac0a9716d2b29feafe0"
+
+	if got := authUserSignature("secret", "alice", 1700000000); got != want {
+		t.Errorf("authUserSignature() must be %#v, not %#v", want, got)
+	}
+	if authUserSignature("secret", "alice", 1700000001) == want || authUserSignature("other", "alice", 1700000000) == want {
+		t.Errorf("authUserSignature() must depend on the timestamp and the secret")
+	}
+}
+
+func TestWebProxyUpstreamHeader(t *testing.T) {
+	newUpstream := func(body string) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			io.WriteString(rw, body)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	pass, forced := newUpstream("pass"), newUpstream("forced")
+
+	h := &HTTPWebProxyHandler{
+		Transport:              &http.Transport{},
+		Pass:                   pass.URL,
+		UpstreamHeader:         "x-upstream",
+		UpstreamHeaderAllowIPs: []string{"198.51.100.0/24"},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	cases := []struct {
+		RemoteAddr string
+		RealIP     string
+		Body       string
+	}{
+		{"198.51.100.7:1234", "198.51.100.7", "forced"},
+		// a real ip from a spoofed x-forwarded-for must not be trusted
+		{"203.0.113.9:1234", "198.51.100.7", "pass"},
+	}
+
+	for _, c := range cases {
+		ri := new(HTTPRequestInfo)
+		ri.RemoteAddr = netip.MustParseAddrPort(c.RemoteAddr)
+		ri.RealIP = netip.MustParseAddr(c.RealIP)
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("x-upstream", forced.URL)
+		req.Header.Set("x-forwarded-for", c.RealIP)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+
+		if body := rec.Body.String(); body != c.Body {
+			t.Errorf("remote_addr=%s real_ip=%s body must be %#v, not %#v", c.RemoteAddr, c.RealIP, c.Body, body)
+		}
+	}
+}
+
+func TestWebProxyAccelRedirect(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		switch req.URL.Path {
+		case "/protected":
+			rw.Header().Set("x-accel-redirect", "/internal")
+		case "/internal":
+			io.WriteString(rw, "internal")
+		default:
+			rw.Header().Set("x-accel-redirect", "/loop")
+		}
+	}))
+	defer upstream.Close()
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:          upstream.URL,
+		AccelRedirect: true,
+	})
+
+	cases := []struct {
+		Path   string
+		Status int
+		Body   string
+		Hits   int64
+	}{
+		{"/protected", http.StatusOK, "internal", 2},
+		{"/loop", http.StatusBadGateway, "502 Bad Gateway\n", webProxyMaxAccelRedirects + 1},
+	}
+
+	for _, c := range cases {
+		hits.Store(0)
+		resp, err := http.Get(server.URL + c.Path)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL+c.Path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.Status || string(body) != c.Body {
+			t.Errorf("%s must answer %d %q, not %d %q", c.Path, c.Status, c.Body, resp.StatusCode, body)
+		}
+		if n := hits.Load(); n != c.Hits {
+			t.Errorf("%s must hit upstream %d times, not %d", c.Path, c.Hits, n)
+		}
+	}
+}
+
+func TestWebProxyMaxConcurrentAccelRedirect(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/protected" {
+			rw.Header().Set("x-accel-redirect", "/internal")
+			return
+		}
+		io.WriteString(rw, "internal")
+	}))
+	defer upstream.Close()
+
+	// the redirect must reuse the slot of the client request instead of queueing for another one
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:          upstream.URL,
+		AccelRedirect: true,
+		MaxConcurrent: 1,
+		QueueTimeout:  100 * time.Millisecond,
+	})
+
+	resp, err := http.Get(server.URL + "/protected")
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "internal" {
+		t.Errorf("x-accel-redirect with max_concurrent=1 must answer 200 internal, not %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRelativeLocation(t *testing.T) {
+	client := &url.URL{Scheme: "http", Host: "example.com"}
+	upstream := &url.URL{Scheme: "http", Host: "10.0.0.1:8080"}
+
+	cases := []struct {
+		Location string
+		Want     string
+	}{
+		{"http://example.com/a?b=1", "/a?b=1"},
+		{"http://EXAMPLE.com:80", "/"},
+		{"http://10.0.0.1:8080/login", "/login"},
+		// an upgrade to https must stay absolute, or the client loops on http
+		{"https://example.com/a", "https://example.com/a"},
+		{"http://other.com/a", "http://other.com/a"},
+		{"/a", "/a"},
+	}
+
+	for _, c := range cases {
+		if got := relativeLocation(c.Location, client, upstream); got != c.Want {
+			t.Errorf("relativeLocation(%#v) must be %#v, not %#v", c.Location, c.Want, got)
+		}
+	}
+}
+
+func TestAppendJA4HFingerprint(t *testing.T) {
+	cases := []struct {
+		Method  string
+		Headers map[string]string
+		Prefix  string
+	}{
+		{"GET", map[string]string{"Accept-Language": "en-US,en;q=0.9", "Cookie": "b=2; a=1", "Referer": "https://x/", "User-Agent": "curl"}, "ge11cr03enus_"},
+		{"POST", map[string]string{"User-Agent": "curl"}, "po11nn020000_"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.Method, "http://example.org/", nil)
+		for key, value := range c.Headers {
+			req.Header.Set(key, value)
+		}
+
+		ja4h := string(AppendJA4HFingerprint(nil, req))
+		if !strings.HasPrefix(ja4h, c.Prefix) {
+			t.Errorf("ja4h of %s %v must start with %#v, not %#v", c.Method, c.Headers, c.Prefix, ja4h)
+		}
+		if parts := strings.Split(ja4h, "_"); len(parts) != 4 || len(parts[1]) != 12 || len(parts[2]) != 12 || len(parts[3]) != 12 {
+			t.Errorf("ja4h %#v must be 4 parts with 12 hex digits hashes", ja4h)
+		}
+		if _, ok := c.Headers["Cookie"]; !ok && !strings.HasSuffix(ja4h, "_000000000000_000000000000") {
+			t.Errorf("ja4h %#v without cookies must end with zero hashes", ja4h)
+		}
+	}
+
+	req1 := httptest.NewRequest("GET", "http://example.org/", nil)
+	req1.Header.Set("Cookie", "a=1; b=2")
+	req2 := httptest.NewRequest("GET", "http://example.org/", nil)
+	req2.Header.Set("Cookie", "b=2; a=1")
+	if a, b := string(AppendJA4HFingerprint(nil, req1)), string(AppendJA4HFingerprint(nil, req2)); a != b {
+		t.Errorf("ja4h must not depend on the cookie order, %#v != %#v", a, b)
+	}
+}
+
+func TestWebProxySlowBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// respond slower than request_body_read_timeout after a fast upload
+		time.Sleep(300 * time.Millisecond)
+		rw.Write(body)
+	}))
+	defer upstream.Close()
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                   upstream.URL,
+		RequestBodyReadTimeout: 100 * time.Millisecond,
+	})
+
+	resp, err := http.Post(server.URL+"/", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("http.Post(%#v) error: %+v", server.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("slow upstream after a fast upload must succeed, got %d %#v", resp.StatusCode, string(body))
+	}
+
+	// a stalled body is failed after the read timeout instead of holding the upstream request
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", server.Listener.Addr().String(), err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: example.org\r\nContent-Length: 10\r\n\r\nhel")
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < http.StatusBadRequest {
+			t.Fatalf("stalled request body must fail, got %d", resp.StatusCode)
+		}
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("stalled request body must be failed by request_body_read_timeout: %+v", err)
+	}
+}
+
+func TestWebProxyIgnoreTrailerError(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Response string
+		Ignore   bool
+		Complete bool
+	}{
+		{"bad trailer", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nbad trailer line\r\n\r\n", true, true},
+		{"bad trailer not ignored", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nbad trailer line\r\n\r\n", false, false},
+		{"truncated chunk", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\nhello", true, false},
+		{"bad chunk size", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\nzz\r\n", true, false},
+	}
+
+	for _, c := range cases {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:               newTestRawUpstream(t, c.Response),
+			IgnoreTrailerError: c.Ignore,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			// an aborted response may not even have flushed its header
+			if c.Complete {
+				t.Errorf("%s: http.Get(%#v) error: %+v", c.Name, server.URL, err)
+			}
+			continue
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if c.Complete && (err != nil || string(body) != "hello") {
+			t.Errorf("%s: response must complete with %#v, not %#v, err=%+v", c.Name, "hello", string(body), err)
+		}
+		if !c.Complete && err == nil {
+			t.Errorf("%s: a truncated body %#v must not be framed as complete", c.Name, string(body))
+		}
+	}
+}
+
+func TestWebProxyForwardFingerprints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, key := range []string{"x-ja4", "x-alpn", "x-ja4h"} {
+			rw.Header().Set("echo-"+key, req.Header.Get(key))
+		}
+	}))
+	defer upstream.Close()
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:        upstream.URL,
+		ForwardJA4:  true,
+		ForwardALPN: true,
+		ForwardJA4H: true,
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	for _, key := range []string{"x-ja4", "x-alpn", "x-ja4h"} {
+		req.Header.Set(key, "forged")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	resp.Body.Close()
+
+	// a plaintext client has no tls fingerprint, its own values must not reach upstream
+	for _, key := range []string{"x-ja4", "x-alpn"} {
+		if got := resp.Header.Get("echo-" + key); got != "" {
+			t.Errorf("client supplied %s must be removed, not forwarded as %#v", key, got)
+		}
+	}
+	if got := resp.Header.Get("echo-x-ja4h"); got == "" || got == "forged" {
+		t.Errorf("x-ja4h must be computed by the proxy, not %#v", got)
+	}
+}
+
+// newTestSRVServer answers srv queries over udp and tcp of the same port, big. is truncated over
+// udp and badid. is answered with a mismatched id.
+func newTestSRVServer(t *testing.T) string {
+	var pc net.PacketConn
+	var ln net.Listener
+	for range 10 {
+		var err error
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("net.ListenPacket() error: %+v", err)
+		}
+		if ln, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if ln == nil {
+		t.Fatalf("net.Listen() on a free udp port failed")
+	}
+	t.Cleanup(func() { pc.Close(); ln.Close() })
+
+	answer := func(query []byte, tcp bool) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+			return nil
+		}
+		msg.Header.Response = true
+		targets := []uint16{2, 1}
+		switch msg.Questions[0].Name.String() {
+		case "big.test.":
+			if !tcp {
+				msg.Header.Truncated = true
+				targets = nil
+			} else {
+				targets = []uint16{3, 2, 1}
+			}
+		case "badid.test.":
+			msg.Header.ID++
+		}
+		for i, priority := range targets {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: uint32(60 + i)},
+				Body:   &dnsmessage.SRVResource{Priority: priority, Weight: 1, Port: 8080, Target: dnsmessage.MustNewName("backend.test.")},
+			})
+		}
+		b, _ := msg.Pack()
+		return b
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(answer(buf[:n], false), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, int(length[0])<<8|int(length[1]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := answer(query, true)
+				conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+			}()
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestWebProxyQuerySRV(t *testing.T) {
+	h := &HTTPWebProxyHandler{
+		DnsResolver: &DnsResolver{
+			Client: &fastdns.Client{Addr: newTestSRVServer(t)},
+		},
+	}
+
+	cases := []struct {
+		Name       string
+		Priorities []uint16
+		TTL        time.Duration
+	}{
+		{"ok.test", []uint16{1, 2}, 60 * time.Second},
+		{"big.test", []uint16{1, 2, 3}, 60 * time.Second},
+		{"badid.test", nil, 0},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		addrs, ttl, err := h.querySRV(ctx, c.Name)
+		cancel()
+
+		if c.Priorities == nil {
+			if err == nil {
+				t.Errorf("querySRV(%#v) must reject a response of another id, not %v", c.Name, addrs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("querySRV(%#v) error: %+v", c.Name, err)
+		}
+		var priorities []uint16
+		for _, addr := range addrs {
+			priorities = append(priorities, addr.Priority)
+			if srvTarget(addr) != "backend.test:8080" {
+				t.Errorf("querySRV(%#v) target must be backend.test:8080, not %s", c.Name, srvTarget(addr))
+			}
+		}
+		if !slices.Equal(priorities, c.Priorities) || ttl != c.TTL {
+			t.Errorf("querySRV(%#v) must return priorities %v ttl %s, not %v %s", c.Name, c.Priorities, c.TTL, priorities, ttl)
+		}
+	}
+}
+
+func TestWebProxyForwardedTrust(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Header.Get("forwarded"))
+	}))
+	defer upstream.Close()
+
+	h := &HTTPWebProxyHandler{
+		Transport:       &http.Transport{},
+		Pass:            upstream.URL,
+		Forwarded:       true,
+		TrustedProxyIPs: []string{"198.51.100.0/24"},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	cases := []struct {
+		RemoteAddr string
+		Prefix     string
+	}{
+		{"198.51.100.7:1234", "for=192.0.2.1;proto=https, for=198.51.100.7"},
+		// a forged chain of an untrusted client must not reach upstream
+		{"203.0.113.9:1234", "for=203.0.113.9"},
+	}
+
+	for _, c := range cases {
+		ri := new(HTTPRequestInfo)
+		ri.RemoteAddr = netip.MustParseAddrPort(c.RemoteAddr)
+		ri.RealIP = ri.RemoteAddr.Addr()
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("forwarded", "for=192.0.2.1;proto=https")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+
+		if body := rec.Body.String(); !strings.HasPrefix(body, c.Prefix) {
+			t.Errorf("remote_addr=%s forwarded must start with %#v, not %#v", c.RemoteAddr, c.Prefix, body)
+		}
+	}
+}
+
+func TestWebProxyMaxResponseBodySize(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Response string
+		Status   int
+		Complete bool
+	}{
+		{"small", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", http.StatusOK, true},
+		{"declared too large", "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world", http.StatusBadGateway, true},
+		{"chunked too large", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n", http.StatusOK, false},
+		{"upstream truncated", "HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nhello", http.StatusOK, false},
+	}
+
+	for _, c := range cases {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:                newTestRawUpstream(t, c.Response),
+			MaxResponseBodySize: 8,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			// an aborted response may not even have flushed its header
+			if c.Complete {
+				t.Errorf("%s: http.Get(%#v) error: %+v", c.Name, server.URL, err)
+			}
+			continue
+		}
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.Status {
+			t.Errorf("%s: status must be %d, not %d", c.Name, c.Status, resp.StatusCode)
+		}
+		if c.Complete != (err == nil) {
+			t.Errorf("%s: response complete must be %v, err=%+v", c.Name, c.Complete, err)
+		}
+	}
+}
+
+func TestWebProxyMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	h1 := &HTTPWebProxyHandler{Pass: upstream.URL, Metrics: true}
+	h2 := &HTTPWebProxyHandler{Pass: upstream.URL, Metrics: true}
+	server := newTestWebProxyServer(t, h1)
+	newTestWebProxyServer(t, h2)
+
+	if h1.MetricsRegistry == nil || h1.MetricsRegistry == h2.MetricsRegistry {
+		t.Fatalf("each handler must have its own metrics registry")
+	}
+
+	for range 3 {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	metrics, _ := h1.MetricsRegistry.Get(host).(*expvar.Map)
+	if metrics == nil {
+		t.Fatalf("metrics of %#v must exist, got %s", host, h1.MetricsRegistry.String())
+	}
+	// inflight is released once the handler returns, which may trail the client a little
+	for i := 0; i < 100 && metrics.Get("inflight").String() != "0"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, want := range map[string]string{
+		"requests":       "3",
+		"status_2xx":     "3",
+		"latency_count":  "3",
+		"inflight":       "0",
+		"latency_le_10s": "3",
+	} {
+		if v := metrics.Get(name); v == nil || v.String() != want {
+			t.Errorf("metrics %s must be %s, got %v", name, want, v)
+		}
+	}
+	if sum, _ := metrics.Get("latency_seconds_sum").(*expvar.Float); sum == nil || sum.Value() <= 0 {
+		t.Errorf("metrics latency_seconds_sum must be positive, got %v", sum)
+	}
+	if s := h2.MetricsRegistry.String(); s != "{}" {
+		t.Errorf("metrics of an idle handler must be empty, got %s", s)
+	}
+
+	var registry HTTPWebProxyMetrics
+	for i := range webProxyMaxUpstreamMetrics + 10 {
+		registry.Upstream("host"+strconv.Itoa(i)).Add("requests", 1)
+	}
+	if v := registry.Upstream("host0").Get("requests"); v == nil || v.String() != "1" {
+		t.Errorf("metrics of host0 must be kept, got %v", v)
+	}
+	if v := registry.Get("other"); v == nil || v.(*expvar.Map).Get("requests").String() != "10" {
+		t.Errorf("metrics beyond the cap must be counted under other, got %v", v)
+	}
+}
+
+func TestWebProxyEnvFunction(t *testing.T) {
+	t.Setenv("LINER_TEST_TOKEN", "secret")
+	t.Setenv("TEST_TOKEN", "secret")
+
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		io.WriteString(rw, req.Header.Get("x-token"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cases := []struct {
+		Name       string
+		SetHeaders string
+		Pass       string
+		Status     int
+		Body       string
+	}{
+		{"allowed", `x-token: {{ env "LINER_TEST_TOKEN" }}`, upstream.URL, http.StatusOK, "secret"},
+		{"refused header", `x-token: {{ env "TEST_TOKEN" }}`, upstream.URL, http.StatusBadGateway, ""},
+		{"refused pass", "", upstream.URL + `{{ env "TEST_TOKEN" }}`, http.StatusBadGateway, ""},
+	}
+
+	for _, c := range cases {
+		hits.Store(0)
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:       c.Pass,
+			SetHeaders: c.SetHeaders,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("%s: http.Get(%#v) error: %+v", c.Name, server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.Status {
+			t.Errorf("%s: status must be %d, not %d", c.Name, c.Status, resp.StatusCode)
+		}
+		if c.Status == http.StatusOK && string(body) != c.Body {
+			t.Errorf("%s: upstream must see x-token %#v, not %#v", c.Name, c.Body, string(body))
+		}
+		if c.Status != http.StatusOK && hits.Load() != 0 {
+			t.Errorf("%s: upstream must not be requested", c.Name)
+		}
+	}
+}
+
+func TestWebProxyBackoff(t *testing.T) {
+	h := &HTTPWebProxyHandler{RetryBackoff: 100 * time.Millisecond, RetryBackoffMax: time.Second, RetryBackoffMultiplier: 3}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second} {
+		for range 100 {
+			if delay := h.backoff(attempt); delay < want/2 || delay > want {
+				t.Fatalf("backoff(%d) must be within [%v, %v], not %v", attempt, want/2, want, delay)
+			}
+		}
+	}
+
+	if delay := (&HTTPWebProxyHandler{}).backoff(3); delay != 0 {
+		t.Errorf("backoff without retry_backoff must be 0, not %v", delay)
+	}
+
+	for _, h := range []*HTTPWebProxyHandler{
+		{Pass: "http://127.0.0.1", RetryBackoff: -time.Second},
+		{Pass: "http://127.0.0.1", RetryBackoffMultiplier: 0.5},
+		{Pass: "http://127.0.0.1", RetryBackoff: 2 * time.Second, RetryBackoffMax: time.Second},
+	} {
+		h.Transport = &http.Transport{}
+		if err := h.Load(); err == nil {
+			t.Errorf("HTTPWebProxyHandler.Load() must reject retry_backoff=%v retry_backoff_max=%v retry_backoff_multiplier=%v", h.RetryBackoff, h.RetryBackoffMax, h.RetryBackoffMultiplier)
+		}
+	}
+}
+
+func TestWebProxyRetries(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if hits.Add(1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:             upstream.URL,
+		MaxRetries:       2,
+		RetryStatusCodes: []int{http.StatusServiceUnavailable},
+		RetryBackoff:     20 * time.Millisecond,
+	})
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("the third attempt must succeed, got %d %#v", resp.StatusCode, string(body))
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("upstream must be requested 3 times, not %d", n)
+	}
+	// the jittered delays are at least 10ms and 20ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("retries must back off, elapsed %v", elapsed)
+	}
+
+	// a canceled client aborts the backoff
+	h := &HTTPWebProxyHandler{MaxRetries: 1, RetryStatusCodes: []int{http.StatusServiceUnavailable}, RetryBackoff: 10 * time.Second}
+	// without a deadline, which would skip a backoff longer than the time left
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL, nil)
+	start = time.Now()
+	if _, err := h.roundTrip(http.DefaultTransport, req, new(HTTPRequestInfo)); err == nil {
+		t.Errorf("a canceled backoff must return the context error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("a canceled backoff must return promptly, elapsed %v", elapsed)
+	}
+}
+
+func TestWebProxyMaxQueue(t *testing.T) {
+	for _, c := range []struct {
+		MaxQueue int
+		Status   int
+	}{
+		{-1, http.StatusServiceUnavailable},
+		{0, http.StatusOK},
+	} {
+		entered, release := make(chan struct{}, 2), make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			entered <- struct{}{}
+			<-release
+			io.WriteString(rw, "ok")
+		}))
+
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:          upstream.URL,
+			MaxConcurrent: 1,
+			MaxQueue:      c.MaxQueue,
+			QueueTimeout:  5 * time.Second,
+		})
+
+		// the first request holds the only slot until released
+		done := make(chan error, 1)
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		<-entered
+
+		start := time.Now()
+		if c.MaxQueue >= 0 {
+			time.AfterFunc(100*time.Millisecond, func() { close(release) })
+		}
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("max_queue=%d: http.Get(%#v) error: %+v", c.MaxQueue, server.URL, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.Status {
+			t.Errorf("max_queue=%d: status must be %d, not %d", c.MaxQueue, c.Status, resp.StatusCode)
+		}
+		if c.MaxQueue < 0 {
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("max_queue=%d: a full limit must reject at once, elapsed %v", c.MaxQueue, elapsed)
+			}
+			close(release)
+		}
+
+		if err := <-done; err != nil {
+			t.Errorf("max_queue=%d: first request error: %+v", c.MaxQueue, err)
+		}
+		upstream.Close()
+	}
+}
+
+func TestWebProxyCoalesce(t *testing.T) {
+	var hits atomic.Int32
+	entered, release := make(chan struct{}, 16), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		entered <- struct{}{}
+		<-release
+		io.WriteString(rw, "hello "+req.Header.Get("authorization"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:     upstream.URL,
+		Coalesce: true,
+	})
+
+	get := func(auth string) string {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/coalesce", nil)
+		if auth != "" {
+			req.Header.Set("authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("http.Get(%#v) error: %+v", req.URL.String(), err)
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	bodies := make(chan string, 8)
+	go func() { bodies <- get("") }()
+	<-entered
+	for range 4 {
+		go func() { bodies <- get("") }()
+	}
+	// credentials are part of the key, so this one goes upstream on its own
+	go func() { bodies <- get("Bearer other") }()
+	<-entered
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	var shared int
+	for range 6 {
+		if body := <-bodies; body == "hello " {
+			shared++
+		} else if body != "hello Bearer other" {
+			t.Errorf("unexpected body %#v", body)
+		}
+	}
+	if shared != 5 {
+		t.Errorf("5 identical requests must be answered, got %d", shared)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream must be requested once per key, not %d times", n)
+	}
+
+	for _, h := range []*HTTPWebProxyHandler{
+		{Pass: upstream.URL, Coalesce: true, SetHeaders: "x-user: {{ .Username }}"},
+		{Pass: upstream.URL, Coalesce: true, AuthUserHeader: "x-user"},
+		{Pass: upstream.URL, Coalesce: true, ForwardJA4: true},
+	} {
+		h.Transport = &http.Transport{}
+		if err := h.Load(); err == nil {
+			t.Errorf("HTTPWebProxyHandler.Load() must reject coalesce with per-client headers, set_headers=%q auth_user_header=%q forward_ja4=%v", h.SetHeaders, h.AuthUserHeader, h.ForwardJA4)
+		}
+	}
+}
+
+func TestWebProxyTimeout(t *testing.T) {
+	h := &HTTPWebProxyHandler{TimeoutHeader: "x-upstream-timeout", MaxTimeout: 5 * time.Second}
+
+	cases := []struct {
+		Name    string
+		Timeout time.Duration
+		Header  string
+		Attr    string
+		Trusted bool
+		Want    time.Duration
+	}{
+		{"unset", 0, "", "", true, 0},
+		{"default", 2 * time.Second, "", "", true, 2 * time.Second},
+		{"header", 0, "3", "", true, 3 * time.Second},
+		{"header clamped", 0, "10s", "", true, 5 * time.Second},
+		{"header untrusted", time.Second, "3", "", false, time.Second},
+		{"attr", time.Second, "3", "4s", true, 4 * time.Second},
+		{"attr clamped", 0, "", "60", false, 5 * time.Second},
+	}
+
+	for _, c := range cases {
+		h.Timeout = c.Timeout
+		req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+		if c.Header != "" {
+			req.Header.Set(h.TimeoutHeader, c.Header)
+		}
+		ri := new(HTTPRequestInfo)
+		ri.RemoteAddr = netip.MustParseAddrPort("203.0.113.1:1234")
+		if c.Trusted {
+			ri.RemoteAddr = netip.MustParseAddrPort("127.0.0.1:1234")
+		}
+		if c.Attr != "" {
+			ri.AuthUserInfo.Attrs = map[string]string{"timeout": c.Attr}
+		}
+
+		if got := h.timeout(req, ri); got != c.Want {
+			t.Errorf("%s: timeout must be %v, not %v", c.Name, c.Want, got)
+		}
+		if req.Header.Get(h.TimeoutHeader) != "" {
+			t.Errorf("%s: %s must not be forwarded", c.Name, h.TimeoutHeader)
+		}
+	}
+}
+
+func TestWebProxyCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                    upstream.URL,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  100 * time.Millisecond,
+	})
+
+	get := func() int {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i, want := range []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		if status := get(); status != want {
+			t.Errorf("request %d: status must be %d, not %d", i+1, want, status)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("an open breaker must not reach upstream, got %d hits", n)
+	}
+
+	// after the cooldown a successful probe closes the breaker
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	for i := range 2 {
+		if status := get(); status != http.StatusOK {
+			t.Errorf("request %d after cooldown: status must be 200, not %d", i+1, status)
+		}
+	}
+	if n := hits.Load(); n != 4 {
+		t.Errorf("a closed breaker must reach upstream, got %d hits", n)
+	}
+}
+
+func TestWebProxyRetryStatusCodes(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, req.Body)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:             upstream.URL,
+		MaxRetries:       2,
+		RetryStatusCodes: []int{http.StatusServiceUnavailable},
+	})
+
+	cases := []struct {
+		Method string
+		Hits   int32
+	}{
+		// the last response is relayed once the retries are exhausted
+		{http.MethodGet, 3},
+		// a streamed body of a non-idempotent request is never sent twice
+		{http.MethodPost, 1},
+	}
+
+	for _, c := range cases {
+		hits.Store(0)
+		var body io.Reader
+		if c.Method == http.MethodPost {
+			body = strings.NewReader("body")
+		}
+		req, _ := http.NewRequest(c.Method, server.URL, body)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %#v error: %+v", c.Method, server.URL, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status must be 503, not %d", c.Method, resp.StatusCode)
+		}
+		if n := hits.Load(); n != c.Hits {
+			t.Errorf("%s: upstream must be requested %d times, not %d", c.Method, c.Hits, n)
+		}
+	}
+}
+
+func TestWebProxyMirror(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(rw, "upstream "+string(body))
+	}))
+	t.Cleanup(upstream.Close)
+
+	type mirrored struct {
+		Method, Path, Body string
+	}
+	mirrors := make(chan mirrored, 4)
+	mirror := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mirrors <- mirrored{req.Method, req.URL.Path, string(body)}
+		// the mirror response is discarded
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(mirror.Close)
+
+	for _, rate := range []float64{1, 0} {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:             upstream.URL,
+			MirrorPass:       mirror.URL,
+			MirrorSampleRate: rate,
+		})
+
+		resp, err := http.Post(server.URL+"/shadow", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("http.Post(%#v) error: %+v", server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "upstream hello" {
+			t.Errorf("mirror_sample_rate=%v: client must get the upstream response, not %d %#v", rate, resp.StatusCode, string(body))
+		}
+
+		select {
+		case m := <-mirrors:
+			if rate == 0 {
+				t.Errorf("mirror_sample_rate=0 must not mirror, got %+v", m)
+			} else if m != (mirrored{http.MethodPost, "/shadow", "hello"}) {
+				t.Errorf("mirror must get a copy of the request, not %+v", m)
+			}
+		case <-time.After(time.Second):
+			if rate != 0 {
+				t.Errorf("mirror_sample_rate=%v: mirror must be requested", rate)
+			}
+		}
+	}
+}
+
+func TestWebProxyTap(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		io.WriteString(rw, "upstream body")
+	}))
+	t.Cleanup(upstream.Close)
+
+	filename := filepath.Join(t.TempDir(), "tap.log")
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:          upstream.URL,
+		TapFile:       filename,
+		TapSampleRate: 1,
+		TapMaxBytes:   4,
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/tap", strings.NewReader("hello"))
+	req.Header.Set("authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Post(%#v) error: %+v", server.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream body" {
+		t.Errorf("the tapped response must be relayed untouched, not %#v", string(body))
+	}
+
+	// the tap is written asynchronously once the response finished
+	var data []byte
+	for i := 0; i < 100 && !bytes.Contains(data, []byte("\n")); i++ {
+		time.Sleep(20 * time.Millisecond)
+		data, _ = os.ReadFile(filename)
+	}
+	for _, want := range []string{`/tap"`, `"req_body":"hell"`, `"req_body_bytes":5`, `"status":200`, `"resp_body":"upst"`, `"resp_body_bytes":13`} {
+		if !bytes.Contains(data, []byte(want)) {
+			t.Errorf("tap must contain %s, got %s", want, data)
+		}
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Errorf("tap must redact the authorization header, got %s", data)
+	}
+}
+
+func TestWebProxyDeny(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := &HTTPWebProxyHandler{
+		Transport: &http.Transport{},
+		Pass:      upstream.URL,
+		Deny: HTTPWebProxyDeny{
+			JA4:            []string{"t13d1516h2_*"},
+			UserAgentNames: []string{"curl"},
+			CIDRs:          []string{"198.51.100.0/24", "203.0.113.7"},
+			Status:         http.StatusTeapot,
+			Tarpit:         50 * time.Millisecond,
+		},
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	cases := []struct {
+		Name      string
+		RealIP    string
+		JA4       string
+		UserAgent string
+		Status    int
+	}{
+		{"allowed", "192.0.2.1", "t13d1715h2_5b57614c22b0_3d5424432f57", "Firefox", http.StatusOK},
+		{"ja4", "192.0.2.1", "t13d1516h2_8daaf6152771_02713d6af862", "Firefox", http.StatusTeapot},
+		{"user agent", "192.0.2.1", "", "curl", http.StatusTeapot},
+		{"cidr", "198.51.100.9", "", "", http.StatusTeapot},
+		{"ip", "203.0.113.7", "", "", http.StatusTeapot},
+	}
+
+	for _, c := range cases {
+		ri := new(HTTPRequestInfo)
+		ri.RealIP = netip.MustParseAddr(c.RealIP)
+		ri.RemoteAddr = netip.AddrPortFrom(ri.RealIP, 1234)
+		ri.JA4 = c.JA4
+		ri.UserAgent.Name = c.UserAgent
+
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+
+		if rec.Code != c.Status {
+			t.Errorf("%s: status must be %d, not %d", c.Name, c.Status, rec.Code)
+		}
+		if elapsed := time.Since(start); c.Status != http.StatusOK && elapsed < h.Deny.Tarpit {
+			t.Errorf("%s: a denied request must be tarpitted, elapsed %v", c.Name, elapsed)
+		}
+	}
+}
+
+func TestWebProxyMaintenance(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := &HTTPWebProxyHandler{
+		Transport:             &http.Transport{},
+		Pass:                  upstream.URL,
+		Maintenance:           true,
+		MaintenanceAllowIPs:   []string{"192.0.2.0/24"},
+		MaintenancePage:       "<h1>back soon</h1>",
+		MaintenanceRetryAfter: 60,
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	serve := func(realip string) *httptest.ResponseRecorder {
+		ri := new(HTTPRequestInfo)
+		ri.RealIP = netip.MustParseAddr(realip)
+		ri.RemoteAddr = netip.AddrPortFrom(ri.RealIP, 1234)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+		return rec
+	}
+
+	rec := serve("203.0.113.1")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != h.MaintenancePage || rec.Header().Get("retry-after") != "60" {
+		t.Errorf("maintenance must serve the page, not %d %#v %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if rec := serve("192.0.2.1"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("maintenance_allow_ips must reach upstream, not %d %#v", rec.Code, rec.Body.String())
+	}
+
+	h.SetMaintenance(false)
+	if rec := serve("203.0.113.1"); rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("maintenance off must reach upstream, not %d %#v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWebProxyRewriteCookie(t *testing.T) {
+	h := &HTTPWebProxyHandler{
+		CookieDomains:  map[string]string{"backend.internal": "example.com", "drop.internal": ""},
+		CookiePaths:    map[string]string{"/api/": "/", "/app": "/v2/app"},
+		CookieSecure:   true,
+		CookieSameSite: "Lax",
+	}
+
+	cases := []struct {
+		Cookie string
+		Want   string
+	}{
+		{"a=1; Domain=backend.internal; Path=/api/users; HttpOnly", "a=1; Domain=example.com; Path=/users; HttpOnly; Secure; SameSite=Lax"},
+		{"b=2; Domain=drop.internal; Secure; SameSite=None", "b=2; Secure; SameSite=Lax"},
+		{"c=3; Domain=other.org; Path=/app", "c=3; Domain=other.org; Path=/v2/app; Secure; SameSite=Lax"},
+		{"d=4; Path=/application", "d=4; Path=/application; Secure; SameSite=Lax"},
+		{"e=5; domain=.Backend.Internal; Path=/api/", "e=5; Domain=example.com; Path=/; Secure; SameSite=Lax"},
+	}
+
+	for _, c := range cases {
+		if got := h.rewriteCookie(c.Cookie); got != c.Want {
+			t.Errorf("rewriteCookie(%#v) must be %#v, not %#v", c.Cookie, c.Want, got)
+		}
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("set-cookie", cases[0].Cookie)
+		rw.Header().Add("set-cookie", cases[1].Cookie)
+	}))
+	t.Cleanup(upstream.Close)
+
+	h.Pass = upstream.URL
+	server := newTestWebProxyServer(t, h)
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Values("set-cookie"); !slices.Equal(got, []string{cases[0].Want, cases[1].Want}) {
+		t.Errorf("set-cookie of the response must be rewritten, not %#v", got)
+	}
+}
+
+func TestWebProxyStickyCookie(t *testing.T) {
+	var upstreams []string
+	for _, name := range []string{"a", "b"} {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			io.WriteString(rw, name)
+		}))
+		t.Cleanup(server.Close)
+		upstreams = append(upstreams, strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:         "http://upstream",
+		Upstreams:    upstreams,
+		StickyCookie: HTTPWebProxyStickyCookie{Name: "lb", Secret: "secret", TTL: time.Hour},
+	})
+
+	get := func(cookie string) (string, *http.Cookie) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "lb", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		for _, c := range resp.Cookies() {
+			if c.Name == "lb" {
+				return string(body), c
+			}
+		}
+		return string(body), nil
+	}
+
+	pinned, cookie := get("")
+	if cookie == nil || !cookie.HttpOnly || cookie.MaxAge != 3600 {
+		t.Fatalf("the first request must be pinned by an http only cookie, not %+v", cookie)
+	}
+	for _, addr := range upstreams {
+		if strings.Contains(cookie.Value, addr) {
+			t.Errorf("the cookie must not expose the upstream address, got %#v", cookie.Value)
+		}
+	}
+
+	for range 10 {
+		body, c := get(cookie.Value)
+		if body != pinned {
+			t.Errorf("a pinned request must stay on upstream %s, not %s", pinned, body)
+		}
+		if c != nil {
+			t.Errorf("a valid cookie must not be set again, got %+v", c)
+		}
+	}
+
+	// a forged cookie is replaced with a signed one
+	if _, c := get("forged"); c == nil || c.Value == "forged" {
+		t.Errorf("a forged cookie must be replaced, got %+v", c)
+	}
+}
+
+func TestWebProxyBufferRequestBody(t *testing.T) {
+	type seen struct {
+		ContentLength int64
+		Body          string
+	}
+	seens := make(chan seen, 8)
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		seens <- seen{req.ContentLength, string(body)}
+		if hits.Add(1) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                  upstream.URL,
+		BufferRequestBody:     true,
+		BufferRequestMaxBytes: 8,
+		MaxRetries:            1,
+		RetryStatusCodes:      []int{http.StatusServiceUnavailable},
+	})
+
+	post := func(body string) int {
+		// a reader of unknown length makes the client send a chunked body
+		resp, err := http.Post(server.URL, "text/plain", io.MultiReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatalf("http.Post(%#v) error: %+v", server.URL, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a buffered body has a known length and is replayed by the retry
+	if status := post("hello"); status != http.StatusOK {
+		t.Errorf("a buffered post must be retried, got status %d", status)
+	}
+	for range 2 {
+		if s := <-seens; s != (seen{5, "hello"}) {
+			t.Errorf("upstream must get the buffered body, not %+v", s)
+		}
+	}
+
+	// a body over buffer_request_max_bytes is streamed, and so never retried
+	hits.Store(0)
+	if status := post("hello world"); status != http.StatusServiceUnavailable {
+		t.Errorf("a streamed post must not be retried, got status %d", status)
+	}
+	if s := <-seens; s != (seen{-1, "hello world"}) {
+		t.Errorf("upstream must get the streamed body, not %+v", s)
+	}
+}
+
+func TestWebProxyBufferResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := "hello"
+		switch req.URL.Path {
+		case "/large":
+			body = "hello world"
+		case "/sse":
+			rw.Header().Set("content-type", "text/event-stream")
+		}
+		// flushed in parts, so upstream sends a chunked body of unknown length
+		for part := range strings.SplitSeq(body, " ") {
+			io.WriteString(rw, part)
+			rw.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                   upstream.URL,
+		BufferResponse:         true,
+		BufferResponseMaxBytes: 8,
+	})
+
+	cases := []struct {
+		Path          string
+		ContentLength int64
+		Body          string
+	}{
+		{"/small", 5, "hello"},
+		// over buffer_response_max_bytes or a stream, the body is relayed as it comes
+		{"/large", -1, "helloworld"},
+		{"/sse", -1, "hello"},
+	}
+
+	for _, c := range cases {
+		resp, err := http.Get(server.URL + c.Path)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL+c.Path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.ContentLength != c.ContentLength || string(body) != c.Body {
+			t.Errorf("%s: response must be %d %#v, not %d %#v", c.Path, c.ContentLength, c.Body, resp.ContentLength, string(body))
+		}
+	}
+}
+
+func TestWebProxyHeaderSizeLimits(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hits.Add(1)
+		if req.URL.Path == "/big" {
+			rw.Header().Set("x-big", strings.Repeat("x", 4096))
+		}
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                   upstream.URL,
+		MaxRequestHeaderBytes:  1024,
+		MaxResponseHeaderBytes: 1024,
+	})
+
+	cases := []struct {
+		Name   string
+		Path   string
+		Header string
+		Status int
+		Hits   int32
+	}{
+		{"small", "/", "", http.StatusOK, 1},
+		{"request header too large", "/", strings.Repeat("x", 2048), http.StatusRequestHeaderFieldsTooLarge, 0},
+		{"response header too large", "/big", "", http.StatusBadGateway, 1},
+	}
+
+	for _, c := range cases {
+		hits.Store(0)
+		req, _ := http.NewRequest(http.MethodGet, server.URL+c.Path, nil)
+		if c.Header != "" {
+			req.Header.Set("x-big", c.Header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: http.Get(%#v) error: %+v", c.Name, req.URL.String(), err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.Status {
+			t.Errorf("%s: status must be %d, not %d", c.Name, c.Status, resp.StatusCode)
+		}
+		if n := hits.Load(); n != c.Hits {
+			t.Errorf("%s: upstream must be requested %d times, not %d", c.Name, c.Hits, n)
+		}
+	}
+}
+
+func TestWebProxyResponseIdleTimeout(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("content-length", "10")
+		for i := range 10 {
+			if req.URL.Path == "/stall" && i == 5 {
+				select {
+				case <-release:
+				case <-req.Context().Done():
+				}
+				return
+			}
+			io.WriteString(rw, "x")
+			rw.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:                upstream.URL,
+		ResponseIdleTimeout: 100 * time.Millisecond,
+	})
+
+	// a slow but steady upstream is not an idle one
+	resp, err := http.Get(server.URL + "/steady")
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 10 {
+		t.Errorf("a steady response must be complete, got %d bytes, err=%+v", len(body), err)
+	}
+
+	start := time.Now()
+	resp, err = http.Get(server.URL + "/stall")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("a stalled response must be aborted")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("a stalled response must be aborted after the idle timeout, elapsed %v", elapsed)
+	}
+}
+
+func TestWebProxyAuthUserSignatureHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Header.Get("x-auth-user")+" "+req.Header.Get("x-auth-signature"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	table := filepath.Join(t.TempDir(), "users.csv")
+	if err := os.WriteFile(table, []byte("username,password,allow_proxy\nalice,pass,1\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%#v) error: %+v", table, err)
+	}
+
+	h := &HTTPWebProxyHandler{
+		Transport:      &http.Transport{},
+		Pass:           upstream.URL,
+		AuthTable:      table,
+		AuthUserHeader: "x-auth-user",
+		AuthUserSecret: "secret",
+	}
+	if err := h.Load(); err != nil {
+		t.Fatalf("HTTPWebProxyHandler.Load() error: %+v", err)
+	}
+
+	ri := new(HTTPRequestInfo)
+	ri.RemoteAddr = netip.MustParseAddrPort("203.0.113.1:1234")
+	ri.RealIP = ri.RemoteAddr.Addr()
+	ri.AuthUserInfo.Username, ri.AuthUserInfo.Password = "alice", "pass"
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	// client supplied identity headers are replaced
+	req.Header.Set("x-auth-user", "mallory")
+	req.Header.Set("x-auth-signature", "t=1,v1=forged")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), HTTPRequestInfoContextKey, ri)))
+
+	user, signature, _ := strings.Cut(rec.Body.String(), " ")
+	if rec.Code != http.StatusOK || user != "alice" {
+		t.Fatalf("upstream must get the authenticated user, not %d %#v", rec.Code, rec.Body.String())
+	}
+	ts, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(n, 0)).Abs() > time.Minute {
+		t.Fatalf("the signature must carry the current timestamp, got %#v", signature)
+	}
+	if want := authUserSignature("secret", "alice", n); signature != want {
+		t.Errorf("the signature must be %#v, not %#v", want, signature)
+	}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestWebProxyAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	logs := new(syncBuffer)
+	logger := log.DefaultLogger
+	log.DefaultLogger.Writer = &log.IOWriter{Writer: logs}
+	t.Cleanup(func() { log.DefaultLogger = logger })
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:            upstream.URL,
+		AccessLog:       true,
+		AccessLogFields: []string{"method", "path", "status", "bytes", "upstream", "conn_reused"},
+	})
+
+	resp, err := http.Get(server.URL + "/log?secret=1")
+	if err != nil {
+		t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// the access log is written once the handler returns, which may trail the client a little
+	var line string
+	for i := 0; i < 100 && line == ""; i++ {
+		for s := range strings.SplitSeq(logs.String(), "\n") {
+			if strings.Contains(s, `"web proxy access"`) {
+				line = s
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, want := range []string{`"method":"GET"`, `"path":"/log"`, `"status":200`, `"bytes":2`, `"upstream":"` + strings.TrimPrefix(upstream.URL, "http://") + `"`, `"conn_reused":false`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("access log must contain %s, got %s", want, line)
+		}
+	}
+	for _, unwanted := range []string{`"ja4"`, `"user_agent"`, `secret`} {
+		if strings.Contains(line, unwanted) {
+			t.Errorf("access log must not contain %s, got %s", unwanted, line)
+		}
+	}
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*HTTPTraceSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, span *HTTPTraceSpan) context.Context {
+	return ctx
+}
+
+func (tr *testTracer) End(span *HTTPTraceSpan) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.spans = append(tr.spans, span)
+}
+
+func TestWebProxyTracePropagation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Header.Get("traceparent")+" "+req.Header.Get("tracestate"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	tracer := new(testTracer)
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass:             upstream.URL,
+		TracePropagation: true,
+		Tracer:           tracer,
+	})
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	cases := []struct {
+		Traceparent string
+		Tracestate  string
+		Continued   bool
+	}{
+		{traceparent, "congo=t61rcWkgMzE", true},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "congo=t61rcWkgMzE", false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if c.Traceparent != "" {
+			req.Header.Set("traceparent", c.Traceparent)
+			req.Header.Set("tracestate", c.Tracestate)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		got, state, _ := strings.Cut(string(body), " ")
+		parts := strings.Split(got, "-")
+		if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || parts[3] != "01" {
+			t.Fatalf("traceparent %#v: upstream must get a valid traceparent, not %#v", c.Traceparent, got)
+		}
+		if parts[2] == "00f067aa0ba902b7" {
+			t.Errorf("traceparent %#v: upstream must get a new span id, not %#v", c.Traceparent, got)
+		}
+		if continued := parts[1] == "4bf92f3577b34da6a3ce929d0e0e4736"; continued != c.Continued {
+			t.Errorf("traceparent %#v: the trace must be continued=%v, got %#v", c.Traceparent, c.Continued, got)
+		}
+		if wantState := map[bool]string{true: c.Tracestate}[c.Continued]; state != wantState {
+			t.Errorf("traceparent %#v: upstream must get tracestate %#v, not %#v", c.Traceparent, wantState, state)
+		}
+	}
+
+	// spans end once the response was relayed, which may trail the client a little
+	for i := 0; i < 100; i++ {
+		tracer.mu.Lock()
+		n := len(tracer.spans)
+		tracer.mu.Unlock()
+		if n == len(cases) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) != len(cases) {
+		t.Fatalf("tracer must end %d spans, not %d", len(cases), len(tracer.spans))
+	}
+	i := slices.IndexFunc(tracer.spans, func(span *HTTPTraceSpan) bool { return hex.EncodeToString(span.ParentSpanID[:]) == "00f067aa0ba902b7" })
+	if i < 0 {
+		t.Fatalf("tracer must end the span of the continued trace, got %+v", tracer.spans)
+	}
+	if span := tracer.spans[i]; span.StatusCode != http.StatusOK || span.Method != http.MethodGet || span.Err != nil {
+		t.Errorf("span must record the round trip, got %+v", span)
+	}
+}
+
+func TestWebProxyH2C(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Proto)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	host := strings.TrimPrefix(upstream.URL, "http://")
+	cases := []struct {
+		Pass     string
+		ForceH2C bool
+		Proto    string
+	}{
+		{"h2c://" + host, false, "HTTP/2.0"},
+		{"http://" + host, true, "HTTP/2.0"},
+		{"http://" + host, false, "HTTP/1.1"},
+	}
+
+	for _, c := range cases {
+		server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+			Pass:     c.Pass,
+			ForceH2C: c.ForceH2C,
+		})
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != c.Proto {
+			t.Errorf("pass=%s force_h2c=%v: upstream must be requested over %s, not %#v", c.Pass, c.ForceH2C, c.Proto, string(body))
+		}
+	}
+}
+
+func TestWebProxyTrailers(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		rw.Header().Set("content-type", "application/grpc")
+		rw.Header().Set("trailer", "grpc-status")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte{0, 0, 0, 0, 2, 'o', 'k'})
+		rw.Header().Set("grpc-status", "0")
+		// not announced before the body
+		rw.Header().Set(http.TrailerPrefix+"grpc-message", "done")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+
+	server := newTestWebProxyServer(t, &HTTPWebProxyHandler{
+		Pass: "h2c://" + strings.TrimPrefix(upstream.URL, "http://"),
+	})
+
+	resp, err := http.Post(server.URL+"/helloworld.Greeter/SayHello", "application/grpc", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatalf("http.Post(%#v) error: %+v", server.URL, err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 7 {
+		t.Fatalf("the grpc message must be relayed, got %v err=%+v", body, err)
+	}
+
+	if got := resp.Trailer.Get("grpc-status"); got != "0" {
+		t.Errorf("the announced trailer grpc-status must be relayed, got %#v in %v", got, resp.Trailer)
+	}
+	if got := resp.Trailer.Get("grpc-message"); got != "done" {
+		t.Errorf("the unannounced trailer grpc-message must be relayed, got %#v in %v", got, resp.Trailer)
+	}
+}
+
+func TestWebProxyDrain(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		entered <- struct{}{}
+		<-release
+		io.WriteString(rw, "ok")
+	}))
+	t.Cleanup(upstream.Close)
+
+	h := &HTTPWebProxyHandler{Pass: upstream.URL, HealthPath: "/healthz"}
+	server := newTestWebProxyServer(t, h)
+
+	inflight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			inflight <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		inflight <- resp.StatusCode
+	}()
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() must wait for the in-flight request, got %+v", err)
+	}
+
+	for _, path := range []string{"/", "/healthz"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("http.Get(%#v) error: %+v", server.URL+path, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: a draining handler must answer 503, not %d", path, resp.StatusCode)
+		}
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- h.Drain(context.Background()) }()
+	close(release)
+
+	if status := <-inflight; status != http.StatusOK {
+		t.Errorf("the in-flight request must complete, got status %d", status)
+	}
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Drain() error: %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Drain() must return once the in-flight request completed")
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// transport picks the round tripper of proxypass and points req at it.
+func (h *HTTPWebProxyHandler) transport(req *http.Request, proxypass *url.URL) http.RoundTripper {
+	var tr http.RoundTripper
+	switch proxypass.Scheme {
+	case "http3":
+		tr = h.h3transport
+		req.URL.Scheme = "https"
+		req.URL.Host = proxypass.Host
+		req.Host = proxypass.Host
+	case "h2c":
+		tr = h.h2ctransport
+		req.URL.Scheme = "http"
+		req.URL.Host = proxypass.Host
+		req.Host = proxypass.Host
+	default:
+		tr = h.Transport
+		if h.ForceH2C && proxypass.Scheme == "http" {
+			tr = h.h2ctransport
+		} else if h.nokeepalive != nil && (h.ForceConnectionClose || slices.Contains(h.DisableKeepAliveUpstreams, proxypass.Host) || slices.Contains(h.DisableKeepAliveUpstreams, proxypass.Hostname())) {
+			tr = h.nokeepalive
+		}
+		req.URL.Scheme = proxypass.Scheme
+		req.URL.Host = proxypass.Host
+		req.Host = proxypass.Host
+	}
+
+	return tr
+}
+
+var webProxyUpstreamKey any = &HTTPContextKey{"web-proxy-upstream"}
+
+func (h *HTTPWebProxyHandler) dial(ctx context.Context, proxypass *url.URL) (net.Conn, string, error) {
+	hostport := proxypass.Host
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		port := "80"
+		if proxypass.Scheme == "https" {
+			port = "443"
+		}
+		hostport = net.JoinHostPort(hostport, port)
+	}
+
+	conn, err := h.Transport.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, hostport, err
+	}
+
+	if proxypass.Scheme == "https" {
+		config := h.Transport.TLSClientConfig
+		if config == nil || config.ServerName == "" {
+			config = config.Clone()
+			if config == nil {
+				config = new(tls.Config)
+			}
+			config.ServerName = proxypass.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		err := tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, hostport, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, hostport, nil
+}
+
+// withDialPolicy passes the address family preference of DialPolicy to the dialer, happy eyeballs by default.
+func (h *HTTPWebProxyHandler) withDialPolicy(ctx context.Context) context.Context {
+	switch h.DialPolicy {
+	case "prefer_ipv4":
+		// the dns resolver sorts ipv4 addresses first
+		return ctx
+	case "prefer_ipv6":
+		return context.WithValue(ctx, DialerPreferIPv6ContextKey, struct{}{})
+	default:
+		return context.WithValue(ctx, DialerHappyEyeballsContextKey, struct{}{})
+	}
+}
+
+// timeout returns the upstream timeout of req, the auth user "timeout" attribute takes precedence over
+// TimeoutHeader of trusted clients and Timeout, and it is clamped to MaxTimeout, which is only an upper bound
+// so requests without a timeout stay unlimited.
+func (h *HTTPWebProxyHandler) timeout(req *http.Request, ri *HTTPRequestInfo) time.Duration {
+	parse := func(s string) time.Duration {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			n, _ := strconv.Atoi(s)
+			d = time.Duration(n) * time.Second
+		}
+		return max(d, 0)
+	}
+
+	timeout := h.Timeout
+	if name := h.TimeoutHeader; name != "" {
+		if s := req.Header.Get(name); s != "" && h.trustedDownstream(ri) {
+			timeout = cmp.Or(parse(s), timeout)
+		}
+		req.Header.Del(name)
+	}
+	if s := ri.AuthUserInfo.Attrs["timeout"]; s != "" {
+		timeout = cmp.Or(parse(s), timeout)
+	}
+	if h.MaxTimeout > 0 && timeout > h.MaxTimeout {
+		timeout = h.MaxTimeout
+	}
+	return timeout
+}
+
+var errSlowRequestBody = errors.New("request body is too slow")
+
+// slowBodyReader fails a request body which stalls for timeout, or which falls below minRate bytes
+// per second after a grace period, the client connection is unblocked by an expired read deadline.
+type slowBodyReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+	minRate int64
+	start   time.Time
+	n       int64
+	slow    bool
+}
+
+func (r *slowBodyReader) Read(b []byte) (n int, err error) {
+	if r.timeout > 0 {
+		r.rc.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	n, err = r.ReadCloser.Read(b)
+	r.n += int64(n)
+	switch {
+	case err != nil:
+		// net/http starts a background read once the body is done, a stale deadline firing there
+		// while upstream is still responding would cancel the request context.
+		r.rc.SetReadDeadline(time.Time{})
+	case r.minRate > 0:
+		if elapsed := time.Since(r.start); elapsed > cmp.Or(r.timeout, 5*time.Second) && float64(r.n) < float64(r.minRate)*elapsed.Seconds() {
+			// the past deadline is kept on purpose, it fails any further read of the abandoned
+			// body so that the connection of the slow client is closed rather than reused.
+			r.slow = true
+			r.rc.SetReadDeadline(time.Now())
+			return n, errSlowRequestBody
+		}
+	}
+	return
+}
+
+func (r *slowBodyReader) Close() error {
+	if !r.slow {
+		r.rc.SetReadDeadline(time.Time{})
+	}
+	return r.ReadCloser.Close()
+}
+
+// bufferRequestBody reads the request body up to BufferRequestMaxBytes before upstream is dialed,
+// the buffered body is replayable by retries. a larger body is streamed as usual.
+func (h *HTTPWebProxyHandler) bufferRequestBody(req *http.Request) error {
+	limit := cmp.Or(h.BufferRequestMaxBytes, 1<<20)
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return nil
+	}
+
+	req.Body.Close()
+	req.ContentLength, req.TransferEncoding = int64(len(data)), nil
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	return nil
+}
+
+// roundTrip sends req to upstream, idempotent or buffered requests are retried on errors and RetryStatusCodes up to MaxRetries,
+// the last response or error is returned.
+func (h *HTTPWebProxyHandler) roundTrip(tr http.RoundTripper, req *http.Request, ri *HTTPRequestInfo) (resp *http.Response, err error) {
+	var retryable bool
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		retryable = h.MaxRetries > 0 && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	default:
+		// a fully buffered body never reached upstream partially, so it is safe to send again
+		retryable = h.MaxRetries > 0 && h.BufferRequestBody && req.GetBody != nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		if h.calls != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.ContentLength == 0 && req.Header.Get("upgrade") == "" {
+			resp, err = h.coalesce(tr, req)
+		} else {
+			resp, err = tr.RoundTrip(req)
+		}
+
+		if !retryable || attempt >= h.MaxRetries || req.Context().Err() != nil {
+			return
+		}
+		if err == nil && !slices.Contains(h.RetryStatusCodes, resp.StatusCode) {
+			return
+		}
+
+		delay := h.backoff(attempt)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			// no time left for another attempt
+			return
+		}
+
+		e := log.Warn().Err(err).Context(ri.LogContext).Str("req_url", req.URL.String()).Int("attempt", attempt+1)
+		if resp != nil {
+			e = e.Int("http_status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		e.Dur("retry_backoff", delay).Msg("proxy_pass retry")
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, req.Context().Err()
+			}
+		}
+	}
+}
+
+// backoff returns the delay before the retry after attempt, it grows by RetryBackoffMultiplier from RetryBackoff
+// up to RetryBackoffMax, with a jitter of up to half of the delay.
+func (h *HTTPWebProxyHandler) backoff(attempt int) time.Duration {
+	if h.RetryBackoff <= 0 {
+		return 0
+	}
+
+	delay := float64(h.RetryBackoff) * math.Pow(cmp.Or(h.RetryBackoffMultiplier, 2), float64(attempt))
+	if limit := float64(cmp.Or(h.RetryBackoffMax, 30*time.Second)); delay > limit {
+		delay = limit
+	}
+
+	// equal jitter, spreads retries of concurrent requests
+	half := delay / 2
+	return time.Duration(half + half*float64(fastrandn(1<<16))/(1<<16))
+}
+
+var defaultWebProxyErrorStatusCodes = map[string]int{
+	"timeout": http.StatusGatewayTimeout,
+	"dns":     http.StatusBadGateway,
+	"refused": http.StatusServiceUnavailable,
+	"reset":   http.StatusBadGateway,
+	"tls":     http.StatusBadGateway,
+	"other":   http.StatusBadGateway,
+}
+
+// webProxyErrorClass classifies an upstream round trip error, the class is the key of ErrorStatusCodes.
+func webProxyErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || os.IsTimeout(err):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	case errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr):
+		return "tls"
+	default:
+		return "other"
+	}
+}
+
+// webProxyCall is an upstream round trip shared by identical concurrent requests.
+type webProxyCall struct {
+	done    chan struct{}
+	header  http.Header // request header of the leader, for vary
+	waiters atomic.Int32
+	resp    *http.Response
+	body    []byte
+}
+
+// coalesce shares one upstream round trip among identical concurrent requests, the response body is buffered up to 4MB
+// only when followers are waiting and its length is known, so streams and long polls are relayed to the leader as is.
+// followers fall back to their own round trip when the leader did not share, or vary headers differ.
+func (h *HTTPWebProxyHandler) coalesce(tr http.RoundTripper, req *http.Request) (*http.Response, error) {
+	const maxBodySize = 4 << 20
+
+	// credentials are part of the key, a response must never be shared across users.
+	key := req.Method + " " + req.URL.String() + "\x00" + req.Header.Get("authorization") + "\x00" + req.Header.Get("cookie")
+	call, loaded := h.calls.LoadOrCompute(key, func() (*webProxyCall, bool) {
+		return &webProxyCall{done: make(chan struct{}), header: req.Header.Clone()}, false
+	})
+
+	if !loaded {
+		defer close(call.done)
+		defer h.calls.Delete(key)
+
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		mediatype, _, _ := strings.Cut(resp.Header.Get("content-type"), ";")
+		if call.waiters.Load() == 0 || resp.ContentLength < 0 || resp.ContentLength > maxBodySize || strings.EqualFold(strings.TrimSpace(mediatype), "text/event-stream") {
+			return resp, nil
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+		if err != nil || len(body) > maxBodySize {
+			// not shareable, relay the rest of body to the leader only
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		// the leader goes on to modify its response headers, share a copy
+		shared := *resp
+		shared.Header, shared.Trailer = resp.Header.Clone(), resp.Trailer.Clone()
+		call.resp, call.body = &shared, body
+		return resp, nil
+	}
+
+	call.waiters.Add(1)
+	select {
+	case <-call.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	if call.resp == nil {
+		return tr.RoundTrip(req)
+	}
+	for _, value := range call.resp.Header.Values("vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" || req.Header.Get(name) != call.header.Get(name) {
+				return tr.RoundTrip(req)
+			}
+		}
+	}
+
+	resp := new(http.Response)
+	*resp = *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Trailer = call.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(call.body))
+	resp.Request = req
+	return resp, nil
+}
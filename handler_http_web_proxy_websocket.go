@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/log"
+)
+
+// extendedConnect relays a websocket over an http2 extended connect, see https://datatracker.ietf.org/doc/html/rfc8441,
+// as an http/1.1 upgrade of upstream.
+func (h *HTTPWebProxyHandler) extendedConnect(rw http.ResponseWriter, req *http.Request, ri *HTTPRequestInfo, proxypass *url.URL, protocol string) {
+	switch protocol {
+	case "websocket":
+		break
+	default:
+		http.Error(rw, "pesudo protocol "+protocol+" is not supportted", http.StatusBadGateway)
+		return
+	}
+	// conn, err := net.DialTimeout("tcp", hostport, time.Duration(cmp.Or(h.DialTimeout, 5))*time.Second)
+	conn, hostport, err := h.dial(req.Context(), proxypass)
+	if err != nil {
+		log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 connect proxypass error")
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	wskey := newWebSocketKey()
+
+	b, ok := appendWebSocketRequest(make([]byte, 0, 1024), req, wskey, cmp.Or(h.MaxRequestHeaderBytes, 64<<10))
+	if !ok {
+		log.Warn().Context(ri.LogContext).Str("proxypass", proxypass.String()).Int("max_request_header_bytes", cmp.Or(h.MaxRequestHeaderBytes, 64<<10)).Msg("http2 websocket request header too large")
+		http.Error(rw, "431 Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	_, err = conn.Write(b)
+	if err != nil {
+		log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 write to proxypass error")
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// bound the response header of upstream, the limit is lifted once the header was read
+	lr := &io.LimitedReader{R: conn, N: cmp.Or(h.MaxResponseHeaderBytes, 1<<20)}
+	br := bufio.NewReader(lr)
+	resp, err := http.ReadResponse(br, req)
+	lr.N = math.MaxInt64
+	if err != nil {
+		log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Msg("http2 read from proxypass error")
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	log.Info().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("hostport", hostport).Int("resp_statuscode", resp.StatusCode).Object("resp_header", HTTPHeaderMarshalLogObject(resp.Header)).Msg("http2 get response ok")
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Str("hostport", hostport).Int("resp_statuscode", resp.StatusCode).Msg("http2 swtich 101 from proxypass error")
+		http.Error(rw, "switch protocols failed, resp statuscode: "+strconv.Itoa(resp.StatusCode), http.StatusBadGateway)
+		return
+	}
+
+	if accept := sha1.Sum([]byte(wskey + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11")); resp.Header.Get("sec-websocket-accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		log.Error().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("hostport", hostport).Str("sec_websocket_key", wskey).Str("sec_websocket_accept", resp.Header.Get("sec-websocket-accept")).Msg("http2 websocket accept from proxypass mismatch")
+		http.Error(rw, "switch protocols failed, invalid sec-websocket-accept", http.StatusBadGateway)
+		return
+	}
+
+	// the subprotocol selected by upstream must be one of client offers, see https://datatracker.ietf.org/doc/html/rfc6455#section-4.2.2
+	subprotocol := resp.Header.Get("sec-websocket-protocol")
+	if subprotocol != "" {
+		var offered bool
+		for _, value := range req.Header.Values("sec-websocket-protocol") {
+			for offer := range strings.SplitSeq(value, ",") {
+				if strings.TrimSpace(offer) == subprotocol {
+					offered = true
+				}
+			}
+		}
+		if !offered {
+			log.Error().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("hostport", hostport).Strs("sec_websocket_protocol", req.Header.Values("sec-websocket-protocol")).Str("resp_sec_websocket_protocol", subprotocol).Msg("http2 websocket subprotocol from proxypass not offered")
+			http.Error(rw, "switch protocols failed, invalid sec-websocket-protocol", http.StatusBadGateway)
+			return
+		}
+	}
+
+	// drop the http/1.1 handshake headers, they are not allowed in http2 response
+	for _, key := range []string{"connection", "upgrade", "sec-websocket-accept", "sec-websocket-protocol"} {
+		resp.Header.Del(key)
+	}
+	for _, key := range h.RemoveResponseHeaders {
+		resp.Header.Del(key)
+	}
+	for key, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	if subprotocol != "" {
+		rw.Header().Set("sec-websocket-protocol", subprotocol)
+	}
+	rw.WriteHeader(http.StatusOK)
+
+	rwc := HTTPRequestStream{req.Body, rw, http.NewResponseController(rw), net.TCPAddrFromAddrPort(ri.RemoteAddr), net.TCPAddrFromAddrPort(ri.ServerAddr)}
+	defer rwc.Close()
+
+	h.bridge(rwc, rwc, conn, br)
+}
+
+// switchProtocols bridges the client to an upstream which answered 101 switching protocols.
+func (h *HTTPWebProxyHandler) switchProtocols(rw http.ResponseWriter, req *http.Request, resp *http.Response, ri *HTTPRequestInfo, proxypass *url.URL) {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(rw, "internal error: 101 switching protocols response with non-writable body", 500)
+		return
+	}
+	defer conn.Close()
+
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			rw.Header().Add(k, v)
+		}
+	}
+
+	if canHijack(rw) {
+		log.Debug().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("upgrade_bridge", "hijack").Msg("proxy_pass switching protocols")
+		rw.WriteHeader(resp.StatusCode)
+		lconn, flusher, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Msg("proxy_pass switching protocols hijack error")
+			return
+		}
+		defer lconn.Close()
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+		h.bridge(lconn, flusher, conn, conn)
+		return
+	}
+
+	// servers without hijacking, e.g. http/2, relay the upgraded bytes over the request and response streams,
+	// a 101 is not allowed there, so it is answered with 200 like an extended connect.
+	log.Debug().Context(ri.LogContext).Str("proxypass", proxypass.String()).Str("upgrade_bridge", "stream").Msg("proxy_pass switching protocols")
+	rc := http.NewResponseController(rw)
+	if req.ProtoMajor == 1 {
+		rc.EnableFullDuplex()
+		rw.WriteHeader(resp.StatusCode)
+	} else {
+		for _, key := range []string{"connection", "upgrade"} {
+			rw.Header().Del(key)
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	if err := rc.Flush(); err != nil {
+		log.Error().Context(ri.LogContext).Err(err).Str("proxypass", proxypass.String()).Msg("proxy_pass switching protocols flush error")
+		return
+	}
+	rwc := HTTPRequestStream{req.Body, rw, rc, net.TCPAddrFromAddrPort(ri.RemoteAddr), net.TCPAddrFromAddrPort(ri.ServerAddr)}
+	defer rwc.Close()
+	h.bridge(rwc, rwc, conn, conn)
+}
+
+// appendWebSocketRequest appends the http/1.1 websocket handshake of an http/2 extended connect request,
+// hop-by-hop headers and the handshake headers set by liner are stripped from the client headers, so none
+// is duplicated. it fails when the client headers exceed limit bytes.
+func appendWebSocketRequest(b AppendableBytes, req *http.Request, wskey string, limit int) (AppendableBytes, bool) {
+	hops := []string{"connection", "keep-alive", "proxy-connection", "te", "trailer", "transfer-encoding", "upgrade", "host", "sec-websocket-key"}
+	for _, value := range req.Header.Values("connection") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hops = append(hops, strings.ToLower(name))
+			}
+		}
+	}
+
+	b = b.Str("GET ").Str(req.RequestURI).Str(" HTTP/1.1\r\n")
+	start := len(b)
+	for key, values := range req.Header {
+		if strings.HasPrefix(key, ":") || slices.Contains(hops, strings.ToLower(key)) {
+			continue
+		}
+		for _, value := range values {
+			b = b.Str(key).Str(": ").Str(value).Str("\r\n")
+		}
+		if len(b)-start > limit {
+			return b, false
+		}
+	}
+	b = b.Str("Sec-WebSocket-Key: ").Str(wskey).Str("\r\n")
+	b = b.Str("Upgrade: ").Str(req.Header.Get(":protocol")).Str("\r\n")
+	b = b.Str("Host: ").Str(req.Host).Str("\r\n")
+	b = b.Str("Connection: Upgrade\r\n")
+	b = b.Str("\r\n")
+
+	return b, true
+}
+
+// newWebSocketKey returns a base64 encoded random 16-byte nonce, see https://datatracker.ietf.org/doc/html/rfc6455#section-4.1
+func newWebSocketKey() string {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	return base64.StdEncoding.EncodeToString(nonce[:])
+}
+
+// bridge copies websocket frames or tunneled bytes between client and upstream until either side ends,
+// or nothing is read from both sides within WebSocketIdleTimeout.
+func (h *HTTPWebProxyHandler) bridge(lconn io.WriteCloser, lr io.Reader, conn io.WriteCloser, br io.Reader) {
+	var once sync.Once
+	shutdown := func() {
+		once.Do(func() {
+			lconn.Close()
+			conn.Close()
+		})
+	}
+
+	if h.WebSocketIdleTimeout > 0 {
+		timer := time.AfterFunc(h.WebSocketIdleTimeout, shutdown)
+		defer timer.Stop()
+		lr = &idleTimerReader{lr, timer, h.WebSocketIdleTimeout}
+		br = &idleTimerReader{br, timer, h.WebSocketIdleTimeout}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(lconn, br)
+		shutdown()
+	}()
+
+	io.Copy(conn, lr)
+	shutdown()
+	<-done
+}
+
+// canHijack reports whether rw or a writer it wraps supports hijacking the connection.
+func canHijack(rw http.ResponseWriter) bool {
+	for {
+		switch w := rw.(type) {
+		case http.Hijacker:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			rw = w.Unwrap()
+		default:
+			return false
+		}
+	}
+}
@@ -629,6 +629,33 @@ func (w HTTPFlushWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// HTTPCountingResponseWriter records the status code and body bytes written through it.
+type HTTPCountingResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func (w *HTTPCountingResponseWriter) WriteHeader(code int) {
+	if w.Status == 0 && code >= 200 {
+		w.Status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *HTTPCountingResponseWriter) Write(p []byte) (n int, err error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err = w.ResponseWriter.Write(p)
+	w.Bytes += int64(n)
+	return
+}
+
+func (w *HTTPCountingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 var _ net.Conn = (*HTTPRequestStream)(nil)
 
 type HTTPRequestStream struct {
@@ -1240,6 +1267,98 @@ func AppendJA4Fingerprint(dst []byte, version uint16, info *tls.ClientHelloInfo,
 	return b
 }
 
+// AppendJA4HFingerprint appends the JA4H fingerprint of the http request. net/http does not keep
+// the order of request headers, so the header names are hashed in sorted order instead.
+func AppendJA4HFingerprint(dst []byte, req *http.Request) []byte {
+	b := AppendableBytes(dst)
+
+	if len(req.Method) >= 2 {
+		b = b.Str(strings.ToLower(req.Method[:2]))
+	} else {
+		b = b.Str("00")
+	}
+	switch {
+	case req.ProtoMajor == 1 && req.ProtoMinor == 0:
+		b = b.Str("10")
+	case req.ProtoMajor == 1:
+		b = b.Str("11")
+	case req.ProtoMajor == 2:
+		b = b.Str("20")
+	case req.ProtoMajor == 3:
+		b = b.Str("30")
+	default:
+		b = b.Str("00")
+	}
+	cookies := req.Cookies()
+	if len(cookies) != 0 {
+		b = b.Byte('c')
+	} else {
+		b = b.Byte('n')
+	}
+	if req.Header.Get("referer") != "" {
+		b = b.Byte('r')
+	} else {
+		b = b.Byte('n')
+	}
+
+	names := make([]string, 0, len(req.Header)+1)
+	if req.ProtoMajor == 1 && req.Host != "" {
+		// http/1 sends host as a header, net/http moves it to req.Host
+		names = append(names, "Host")
+	}
+	for name := range req.Header {
+		if name != "Cookie" && name != "Referer" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	if i := uint64(min(len(names), 99)); i < 10 {
+		b = b.Byte('0').Uint64(i, 10)
+	} else {
+		b = b.Uint64(i, 10)
+	}
+
+	lang, _, _ := strings.Cut(req.Header.Get("accept-language"), ",")
+	lang, _, _ = strings.Cut(lang, ";")
+	lang = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "-", ""))
+	lang = (lang + "0000")[:4]
+	b = b.Str(lang)
+
+	b = b.Byte('_')
+
+	buf := AppendableBytes(make([]byte, 0, 256))
+	for _, name := range names {
+		buf = buf.Str(name).Byte(',')
+	}
+	sum := sha256.Sum256(buf[:max(len(buf)-1, 0)])
+	b = b.Hex(sum[:6])
+
+	b = b.Byte('_')
+
+	if len(cookies) != 0 {
+		slices.SortFunc(cookies, func(a, b *http.Cookie) int {
+			return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Value, b.Value))
+		})
+		buf = buf[:0]
+		for _, c := range cookies {
+			buf = buf.Str(c.Name).Byte(',')
+		}
+		sum = sha256.Sum256(buf[:len(buf)-1])
+		b = b.Hex(sum[:6])
+		b = b.Byte('_')
+		buf = buf[:0]
+		for _, c := range cookies {
+			buf = buf.Str(c.Name).Byte('=').Str(c.Value).Byte(',')
+		}
+		sum = sha256.Sum256(buf[:len(buf)-1])
+		b = b.Hex(sum[:6])
+	} else {
+		b = b.Str("000000000000_000000000000")
+	}
+
+	return b
+}
+
 func GetPreferedLocalIP(remote string) (netip.Addr, error) {
 	conn, err := net.Dial("udp", net.JoinHostPort(remote, "443"))
 	if err != nil {
@@ -539,6 +539,7 @@ func main() {
 			},
 			WebHandler: &HTTPWebHandler{
 				Config:          server,
+				DnsResolver:     dnsResolver,
 				DnsResolverPool: dnsResolverPool,
 				MemoryDialers:   memoryDialers,
 				MemoryLogWriter: memoryLogWriter,
@@ -679,7 +680,8 @@ func main() {
 			TLSConfig: &tls.Config{
 				GetConfigForClient: tlsConfigurator.GetConfigForClient,
 			},
-			ConnState: tlsConfigurator.HTTPConnState,
+			ConnState:         tlsConfigurator.HTTPConnState,
+			ReadHeaderTimeout: time.Duration(config.Global.HttpReadHeaderTimeout) * time.Second,
 			ErrorLog: func() *stdLog.Logger {
 				var logger = log.DefaultLogger
 				logger.Writer = log.WriterFunc(func(e *log.Entry) (int, error) {
@@ -765,6 +767,7 @@ func main() {
 			},
 			WebHandler: &HTTPWebHandler{
 				Config:          httpConfig,
+				DnsResolver:     dnsResolver,
 				DnsResolverPool: dnsResolverPool,
 				MemoryDialers:   memoryDialers,
 				MemoryLogWriter: memoryLogWriter,
@@ -819,9 +822,10 @@ func main() {
 	for addr, handler := range h1handlers {
 
 		server := &http.Server{
-			Handler:   handler.HTTPHandler,
-			ErrorLog:  log.DefaultLogger.Std("", 0),
-			ConnState: tlsConfigurator.HTTPConnState,
+			Handler:           handler.HTTPHandler,
+			ErrorLog:          log.DefaultLogger.Std("", 0),
+			ConnState:         tlsConfigurator.HTTPConnState,
+			ReadHeaderTimeout: time.Duration(config.Global.HttpReadHeaderTimeout) * time.Second,
 		}
 
 		var ln net.Listener
@@ -4,7 +4,9 @@ import (
 	"cmp"
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/netip"
@@ -21,6 +23,7 @@ import (
 	"github.com/puzpuzpuz/xsync/v4"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/http2"
 )
 
@@ -213,3 +216,130 @@ func (r *DnsResolver) LookupNetIP(ctx context.Context, network, host string) (ip
 
 	return ips, nil
 }
+
+// Exchange sends the packed dns query to the dns server and returns the response of the same id and
+// question. The conns of fastdns dialers are message oriented, they frame the messages of tcp, dot and
+// doh as handler_dns relays them, and a truncated udp response is retried over tcp.
+func (r *DnsResolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var udp bool
+	var tcpaddr string
+	switch d := r.Client.Dialer.(type) {
+	case nil:
+		udp, tcpaddr = true, r.Client.Addr
+	case *fastdns.UDPDialer:
+		udp, tcpaddr = true, d.Addr.String()
+	}
+
+	resp, err := r.exchange(ctx, query, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if header.Truncated {
+		if !udp {
+			return nil, fmt.Errorf("dns server %s returns a truncated response", r.Client.Addr)
+		}
+		return r.exchange(ctx, query, tcpaddr)
+	}
+
+	return resp, nil
+}
+
+// exchange sends query over a conn of the dialer, or over tcp to tcpaddr with the 2-byte length prefix
+// of RFC 1035, udp responses of a stale query on a pooled conn are skipped.
+func (r *DnsResolver) exchange(ctx context.Context, query []byte, tcpaddr string) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	switch dialer := r.Client.Dialer; {
+	case tcpaddr != "":
+		conn, err = new(net.Dialer).DialContext(ctx, "tcp", tcpaddr)
+		if err == nil {
+			defer conn.Close()
+		}
+	case dialer == nil:
+		conn, err = new(net.Dialer).DialContext(ctx, "udp", r.Client.Addr)
+		if err == nil {
+			defer conn.Close()
+		}
+	default:
+		conn, err = dialer.DialContext(ctx, "", "")
+		if d, _ := dialer.(interface {
+			Put(c net.Conn)
+		}); err == nil && d != nil {
+			defer d.Put(conn)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(cmp.Or(r.Client.Timeout, 5*time.Second))
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	if tcpaddr != "" {
+		if _, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if !dnsResponseOf(query, resp) {
+			return nil, fmt.Errorf("dns server %s returns a mismatched response", tcpaddr)
+		}
+		return resp, nil
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 65535)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		if dnsResponseOf(query, resp[:n]) {
+			return resp[:n], nil
+		}
+		if _, ok := conn.(net.PacketConn); !ok {
+			// only a reused datagram conn may carry responses of other queries
+			return nil, fmt.Errorf("dns server %s returns a mismatched response", r.Client.Addr)
+		}
+	}
+}
+
+// dnsResponseOf reports whether resp is a response of the id and question of query.
+func dnsResponseOf(query, resp []byte) bool {
+	var qp, rp dnsmessage.Parser
+	qh, err := qp.Start(query)
+	if err != nil {
+		return false
+	}
+	rh, err := rp.Start(resp)
+	if err != nil || !rh.Response || rh.ID != qh.ID {
+		return false
+	}
+	qq, err := qp.Question()
+	if err != nil {
+		return false
+	}
+	rq, err := rp.Question()
+	if err != nil {
+		return false
+	}
+	return rq.Type == qq.Type && rq.Class == qq.Class && strings.EqualFold(rq.Name.String(), qq.Name.String())
+}